@@ -1,17 +1,25 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/inaccel/daemon/pkg/plugin"
 	"github.com/inaccel/device-selector/internal"
+	"github.com/inaccel/device-selector/pkg/apis/v1alpha1"
+	"github.com/inaccel/device-selector/pkg/lspci"
+	"github.com/inaccel/device-selector/pkg/sysfs/bus/pci"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 	kubevirtv1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/kubevirt/pkg/hooks/info"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/yaml"
 )
 
 var version string
@@ -27,6 +35,42 @@ func main() {
 				Aliases: []string{"d"},
 				Usage:   "enable debug output",
 			},
+			&cli.BoolFlag{
+				Name:  "cdi",
+				Usage: "write CDI specs for every resource and return CDI devices on allocation",
+			},
+			&cli.PathFlag{
+				Name:  "config",
+				Usage: "resource configuration file to use instead of the KubeVirt CR (reloaded on change)",
+			},
+			&cli.StringFlag{
+				Name:  "dra-driver",
+				Usage: "serve resources as a Dynamic Resource Allocation kubelet plugin with this driver name, instead of device plugins",
+			},
+			&cli.StringFlag{
+				Name:  "health-address",
+				Usage: "address to serve liveness and readiness probes on",
+			},
+			&cli.StringFlag{
+				Name:  "metrics-address",
+				Usage: "address to serve Prometheus metrics on",
+			},
+			&cli.BoolFlag{
+				Name:  "device-inventory",
+				Usage: "publish a DeviceInventory of the node's managed devices",
+			},
+			&cli.BoolFlag{
+				Name:  "iommufd",
+				Usage: "hand out iommufd and vfio device cdevs instead of vfio groups where supported",
+			},
+			&cli.BoolFlag{
+				Name:  "node-features",
+				Usage: "publish device labels and inventory on the node",
+			},
+			&cli.PathFlag{
+				Name:  "policy",
+				Usage: "host device policy file applied by the hook",
+			},
 		},
 		Before: func(context *cli.Context) error {
 			log.SetOutput(io.Discard)
@@ -40,45 +84,280 @@ func main() {
 			return nil
 		},
 		Action: func(context *cli.Context) error {
-			kube, err := config.GetConfig()
-			if err != nil {
+			var api client.Client
+			if kube, err := config.GetConfig(); err == nil {
+				if api, err = client.New(kube, client.Options{}); err != nil {
+					return err
+				}
+
+				if err := kubevirtv1.AddToScheme(api.Scheme()); err != nil {
+					return err
+				}
+				if err := v1alpha1.AddToScheme(api.Scheme()); err != nil {
+					return err
+				}
+			} else if context.Path("config") == "" {
 				return err
+			} else if context.Bool("device-inventory") || context.Bool("node-features") || context.String("dra-driver") != "" {
+				return fmt.Errorf("--device-inventory, --node-features and --dra-driver require Kubernetes API access: %w", err)
 			}
-			api, err := client.New(kube, client.Options{})
-			if err != nil {
-				return err
+
+			node := os.Getenv("NODE_NAME")
+			if node == "" {
+				var err error
+				if node, err = os.Hostname(); err != nil {
+					return err
+				}
 			}
 
-			if err := kubevirtv1.AddToScheme(api.Scheme()); err != nil {
-				return err
+			var events *internal.EventRecorder
+			if api != nil {
+				events = internal.NewEventRecorder(api, node)
 			}
 
-			kubeVirt := &kubevirtv1.KubeVirt{}
-			if err := api.Get(context.Context, client.ObjectKey{
-				Namespace: os.Getenv("KUBE_VIRT_NAMESPACE"),
-				Name:      os.Getenv("KUBE_VIRT_NAME"),
-			}, kubeVirt); err != nil {
-				return err
+			resourcePlugins := func(resources []internal.ResourceConfig) []plugin.New {
+				for index := range resources {
+					if context.Bool("cdi") {
+						resources[index].CDI = true
+					}
+					if context.Bool("iommufd") {
+						resources[index].IOMMUFD = true
+					}
+				}
+
+				var new []plugin.New
+				if context.String("dra-driver") != "" {
+					new = append(new, internal.NewDRAPlugin(context.Context, api, node, context.String("dra-driver"), resources, events))
+				} else {
+					for _, resource := range resources {
+						new = append(new, internal.NewPciHostDevicePlugin(context.Context, resource, events))
+					}
+				}
+				if context.Bool("device-inventory") {
+					new = append(new, internal.NewDeviceInventoryPublisher(context.Context, api, node, resources))
+				}
+				if context.Bool("node-features") {
+					new = append(new, internal.NewNodeFeaturePublisher(context.Context, api, node, resources))
+				}
+				return new
 			}
 
 			new := []plugin.New{
-				internal.NewHook(context.Context),
+				internal.NewHook(context.Context, "inaccel.sock", context.Path("policy"), context.Path("config"), events),
 			}
-			if kubeVirt.Spec.Configuration.PermittedHostDevices != nil {
-				for _, pciHostDevice := range kubeVirt.Spec.Configuration.PermittedHostDevices.PciHostDevices {
-					if pciHostDevice.ExternalResourceProvider {
-						new = append(new, internal.NewPciHostDevicePlugin(context.Context, pciHostDevice))
-					}
+			if context.Path("config") != "" {
+				if _, err := internal.ReadConfig(context.Path("config")); err != nil {
+					return err
 				}
+
+				new = append(new, internal.NewConfigWatcher(context.Context, context.Path("config"), resourcePlugins))
+			} else {
+				resources, err := kubeVirtResources(context, api)
+				if err != nil {
+					return err
+				}
+				new = append(new, resourcePlugins(resources)...)
+			}
+
+			if context.String("health-address") != "" {
+				go func() {
+					if err := internal.ServeHealth(context.Context, context.String("health-address")); err != nil {
+						logrus.Error(err)
+					}
+				}()
+			}
+			if context.String("metrics-address") != "" {
+				go func() {
+					if err := internal.ServeMetrics(context.Context, context.String("metrics-address")); err != nil {
+						logrus.Error(err)
+					}
+				}()
 			}
 
 			plugin.Handle(new...)
 
 			return nil
 		},
+		Commands: []*cli.Command{
+			{
+				Name:  "hook",
+				Usage: "Run the KubeVirt hook sidecar",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "socket",
+						Value: "inaccel.sock",
+						Usage: "name of the hook socket",
+					},
+					&cli.StringSliceFlag{
+						Name:  "hook-point",
+						Value: cli.NewStringSlice(info.OnDefineDomainHookPointName),
+						Usage: "hook points to register",
+					},
+				},
+				Action: func(context *cli.Context) error {
+					for _, hookPoint := range context.StringSlice("hook-point") {
+						switch hookPoint {
+						case info.OnDefineDomainHookPointName:
+						case info.PreCloudInitIsoHookPointName:
+							if err := internal.CheckPodResources(); err != nil {
+								return fmt.Errorf("%s requires the kubelet PodResources socket: %w", hookPoint, err)
+							}
+						default:
+							return fmt.Errorf("unsupported hook point: %s", hookPoint)
+						}
+					}
+
+					plugin.Handle(internal.NewHook(context.Context, context.String("socket"), context.Path("policy"), context.Path("config"), nil, context.StringSlice("hook-point")...))
+
+					return nil
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:  "inventory",
+						Usage: "Print a snapshot of the PCI inventory",
+						Action: func(context *cli.Context) error {
+							data, err := json.MarshalIndent(lspci.ListAll(), "", "\t")
+							if err != nil {
+								return err
+							}
+							fmt.Fprintln(context.App.Writer, string(data))
+
+							return nil
+						},
+					},
+					{
+						Name:      "render",
+						Usage:     "Render a domain the way OnDefineDomain would",
+						ArgsUsage: "[DOMAIN]",
+						Flags: []cli.Flag{
+							&cli.PathFlag{
+								Name:  "inventory",
+								Usage: "PCI inventory snapshot to use instead of sysfs",
+							},
+							&cli.PathFlag{
+								Name:  "vmi",
+								Usage: "VirtualMachineInstance passed along with the domain",
+							},
+						},
+						Action: func(context *cli.Context) error {
+							var domainXML []byte
+							var err error
+							if context.Args().Len() == 0 || context.Args().First() == "-" {
+								domainXML, err = io.ReadAll(context.App.Reader)
+							} else {
+								domainXML, err = os.ReadFile(context.Args().First())
+							}
+							if err != nil {
+								return err
+							}
+
+							var vmiJSON []byte
+							if context.Path("vmi") != "" {
+								data, err := os.ReadFile(context.Path("vmi"))
+								if err != nil {
+									return err
+								}
+								if vmiJSON, err = yaml.YAMLToJSON(data); err != nil {
+									return err
+								}
+							}
+
+							var pciDevices []lspci.PCIDevice
+							if context.Path("inventory") != "" {
+								data, err := os.ReadFile(context.Path("inventory"))
+								if err != nil {
+									return err
+								}
+								if err := json.Unmarshal(data, &pciDevices); err != nil {
+									return err
+								}
+							} else {
+								pciDevices = lspci.ListAll()
+							}
+
+							renderedDomainXML, err := internal.RenderDomain(domainXML, vmiJSON, context.Path("policy"), context.Path("config"), pciDevices)
+							if err != nil {
+								return err
+							}
+							indentedDomainXML, err := internal.IndentDomain(domainXML)
+							if err != nil {
+								return err
+							}
+
+							fmt.Fprintln(context.App.Writer, strings.TrimSuffix(string(renderedDomainXML), "\n"))
+							fmt.Fprintln(context.App.ErrWriter, strings.TrimSuffix(internal.Diff(indentedDomainXML, renderedDomainXML), "\n"))
+
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:      "recover",
+				Usage:     "Power-cycle or re-enumerate a device that fell off the bus",
+				ArgsUsage: "SLOT",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "recover devices that are unmanaged, allocated or missing",
+					},
+				},
+				Action: func(context *cli.Context) error {
+					if context.Args().Len() != 1 {
+						return fmt.Errorf("expected a single slot")
+					}
+					address, err := pci.ParseAddress(context.Args().First())
+					if err != nil {
+						return err
+					}
+
+					var resources []internal.ResourceConfig
+					if context.Path("config") != "" {
+						config, err := internal.ReadConfig(context.Path("config"))
+						if err != nil {
+							return err
+						}
+						resources = config.Resources
+					} else if kube, err := config.GetConfig(); err == nil {
+						api, err := client.New(kube, client.Options{})
+						if err != nil {
+							return err
+						}
+						if err := kubevirtv1.AddToScheme(api.Scheme()); err != nil {
+							return err
+						}
+						if resources, err = kubeVirtResources(context, api); err != nil {
+							return err
+						}
+					}
+
+					return internal.Recover(context.Context, resources, address, context.Bool("force"))
+				},
+			},
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
 		logrus.Fatal(err)
 	}
 }
+
+func kubeVirtResources(context *cli.Context, api client.Client) ([]internal.ResourceConfig, error) {
+	kubeVirt := &kubevirtv1.KubeVirt{}
+	if err := api.Get(context.Context, client.ObjectKey{
+		Namespace: os.Getenv("KUBE_VIRT_NAMESPACE"),
+		Name:      os.Getenv("KUBE_VIRT_NAME"),
+	}, kubeVirt); err != nil {
+		return nil, err
+	}
+
+	var resources []internal.ResourceConfig
+	if kubeVirt.Spec.Configuration.PermittedHostDevices != nil {
+		for _, pciHostDevice := range kubeVirt.Spec.Configuration.PermittedHostDevices.PciHostDevices {
+			if pciHostDevice.ExternalResourceProvider {
+				resources = append(resources, internal.PciHostDeviceResource(pciHostDevice))
+			}
+		}
+	}
+	return resources, nil
+}
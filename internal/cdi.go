@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/inaccel/device-selector/pkg/lspci"
+	"github.com/inaccel/device-selector/pkg/sysfs/bus/pci"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/kubevirt/pkg/util"
+)
+
+const cdiSpecDir = "/var/run/cdi"
+
+type cdiSpec struct {
+	Version string      `json:"cdiVersion"`
+	Kind    string      `json:"kind"`
+	Devices []cdiDevice `json:"devices"`
+}
+
+type cdiDevice struct {
+	Name           string            `json:"name"`
+	ContainerEdits cdiContainerEdits `json:"containerEdits"`
+}
+
+type cdiContainerEdits struct {
+	Env         []string        `json:"env,omitempty"`
+	DeviceNodes []cdiDeviceNode `json:"deviceNodes,omitempty"`
+	Mounts      []cdiMount      `json:"mounts,omitempty"`
+}
+
+type cdiDeviceNode struct {
+	Path        string `json:"path"`
+	HostPath    string `json:"hostPath,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+}
+
+type cdiMount struct {
+	HostPath      string   `json:"hostPath"`
+	ContainerPath string   `json:"containerPath"`
+	Options       []string `json:"options,omitempty"`
+}
+
+func cdiSpecPath(resourceName string) string {
+	return filepath.Join(cdiSpecDir, strings.ReplaceAll(resourceName, "/", "-")+".json")
+}
+
+func cdiDeviceName(resourceName string, address pci.Address) string {
+	return resourceName + "=" + address.String()
+}
+
+func writeCDISpec(resource ResourceConfig) error {
+	spec := &cdiSpec{
+		Version: "0.6.0",
+		Kind:    resource.ResourceName,
+	}
+
+	pciDevices := lspci.ListAll()
+	for _, pciDevice := range resource.units(pciDevices) {
+		containerEdits, err := cdiEdits(resource, pciDevice, pciDevices)
+		if err != nil {
+			return err
+		}
+		spec.Devices = append(spec.Devices, cdiDevice{
+			Name:           pciDevice.Slot.String(),
+			ContainerEdits: containerEdits,
+		})
+	}
+
+	data, err := json.MarshalIndent(spec, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cdiSpecDir, 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that runtimes never observe a
+	// partially written spec.
+	f, err := os.CreateTemp(cdiSpecDir, ".inaccel-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), cdiSpecPath(resource.ResourceName))
+}
+
+// cdiEdits returns the edits of a single device, which cover every member of
+// its unit. CDI env edits replace variables of the same name, so every device
+// sets its own variable and the comma-separated list of the whole request is
+// left to Allocate.
+func cdiEdits(resource ResourceConfig, pciDevice lspci.PCIDevice, pciDevices []lspci.PCIDevice) (cdiContainerEdits, error) {
+	containerEdits := cdiContainerEdits{
+		Env: []string{
+			fmt.Sprintf("%s_%s=%s", util.ResourceNameToEnvVar(kubevirtv1.PCIResourcePrefix, resource.ResourceName), strings.NewReplacer(":", "_", ".", "_").Replace(pciDevice.Slot.String()), pciDevice.Slot),
+		},
+	}
+
+	if resource.container() {
+		for _, member := range resource.members(pciDevice.Slot, pciDevices) {
+			device := pci.Device(member.Slot.String())
+			charDevices, err := device.CharDevices()
+			if err != nil {
+				return containerEdits, err
+			}
+			for _, charDevice := range charDevices {
+				containerEdits.DeviceNodes = append(containerEdits.DeviceNodes, cdiDeviceNode{
+					Path:        charDevice,
+					Permissions: "rw",
+				})
+			}
+			path, err := filepath.EvalSymlinks(device.Path())
+			if err != nil {
+				return containerEdits, err
+			}
+			containerEdits.Mounts = append(containerEdits.Mounts, cdiMount{
+				HostPath:      path,
+				ContainerPath: path,
+				Options: []string{
+					"bind",
+				},
+			})
+		}
+	} else if resource.driver() == "vfio-pci" {
+		for _, path := range resource.vfioDevices(resource.members(pciDevice.Slot, pciDevices)) {
+			containerEdits.DeviceNodes = append(containerEdits.DeviceNodes, cdiDeviceNode{
+				Path:        path,
+				Permissions: "mrw",
+			})
+		}
+	}
+
+	return containerEdits, nil
+}
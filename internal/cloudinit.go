@@ -0,0 +1,279 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/inaccel/device-selector/pkg/lspci"
+	"github.com/inaccel/device-selector/pkg/sysfs/bus/pci"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	acceleratorsPath  = "/etc/inaccel/accelerators.json"
+	modulesAnnotation = "device-selector.inaccel.com/modules"
+)
+
+type accelerator struct {
+	Resource string   `json:"resource"`
+	Slot     string   `json:"slot"`
+	Address  string   `json:"address"`
+	Vendor   lspci.ID `json:"vendor"`
+	Device   lspci.ID `json:"device"`
+	SVendor  lspci.ID `json:"subsystemVendor,omitempty"`
+	SDevice  lspci.ID `json:"subsystemDevice,omitempty"`
+	NUMANode *int     `json:"numaNode,omitempty"`
+}
+
+// deviceData mirrors the device metadata KubeVirt writes to config drives.
+type deviceData struct {
+	Type        string   `json:"type"`
+	Bus         string   `json:"bus"`
+	Address     string   `json:"address"`
+	MAC         string   `json:"mac,omitempty"`
+	Serial      string   `json:"serial,omitempty"`
+	NumaNode    uint32   `json:"numaNode,omitempty"`
+	AlignedCPUs []uint32 `json:"alignedCPUs,omitempty"`
+	Tags        []string `json:"tags"`
+}
+
+// listAccelerators derives the guest address of every accelerator of the VMI
+// through guestBuses, the same way OnDefineDomain places them.
+func listAccelerators(ctx context.Context, vmi *kubevirtv1.VirtualMachineInstance, policies []hostDevicePolicy, units resourceUnits) ([]accelerator, error) {
+	devices, err := podDevices(ctx, vmi, "compute")
+	if err != nil {
+		return nil, err
+	}
+	assigned := map[pci.Address]bool{}
+	for _, devicesIDs := range devices {
+		sort.Strings(devicesIDs)
+		for _, devicesID := range devicesIDs {
+			address, err := pci.ParseAddress(devicesID)
+			if err != nil {
+				return nil, err
+			}
+			assigned[address] = true
+		}
+	}
+
+	allocated, err := otherPodDevices(ctx, vmi)
+	if err != nil {
+		return nil, err
+	}
+	for address := range allocated {
+		assigned[address] = true
+	}
+
+	pciDevices := lspci.ListAll()
+
+	buses := guestBuses(vmi)
+
+	var accelerators []accelerator
+	for _, hostDevice := range vmi.Spec.Domain.Devices.HostDevices {
+		if len(devices[hostDevice.DeviceName]) == 0 {
+			continue
+		}
+		devicesID, err := pci.ParseAddress(devices[hostDevice.DeviceName][0])
+		if err != nil {
+			return nil, err
+		}
+		devices[hostDevice.DeviceName] = devices[hostDevice.DeviceName][1:]
+
+		members, err := hostdevMembers(devicesID, hostDevice.DeviceName, units.of(hostDevice.DeviceName), policies, pciDevices, assigned)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			accelerators = append(accelerators, accelerator{
+				Resource: hostDevice.DeviceName,
+				Slot:     member.pciDevice.Slot.String(),
+				Address:  guestAddress(buses["ua-hostdevice-"+hostDevice.Name], member.function),
+				Vendor:   member.pciDevice.Vendor,
+				Device:   member.pciDevice.Device,
+				SVendor:  member.pciDevice.SVendor,
+				SDevice:  member.pciDevice.SDevice,
+				NUMANode: member.pciDevice.NUMANode,
+			})
+		}
+	}
+	return accelerators, nil
+}
+
+// guestBuses assigns a guest bus to each host device and GPU of the VMI, by
+// alias, in the order the VMI lists them. Both hook points use it, as neither
+// sees the input of the other.
+func guestBuses(vmi *kubevirtv1.VirtualMachineInstance) map[string]uint8 {
+	buses := map[string]uint8{}
+	for _, hostDevice := range vmi.Spec.Domain.Devices.HostDevices {
+		buses["ua-hostdevice-"+hostDevice.Name] = uint8(len(buses) + 1)
+	}
+	for _, gpu := range vmi.Spec.Domain.Devices.GPUs {
+		buses["ua-gpu-"+gpu.Name] = uint8(len(buses) + 1)
+	}
+	return buses
+}
+
+func guestAddress(bus, function uint8) string {
+	return pci.Address{
+		Bus:      bus,
+		Function: function,
+	}.String()
+}
+
+func injectAccelerators(cloudInitData map[string]json.RawMessage, accelerators []accelerator, modules []string) error {
+	data, err := json.MarshalIndent(accelerators, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	writeFiles := []map[string]string{
+		{
+			"path":        acceleratorsPath,
+			"content":     string(data) + "\n",
+			"permissions": "0644",
+		},
+	}
+	cloudConfig := map[string]interface{}{
+		"write_files": writeFiles,
+	}
+	if len(modules) > 0 {
+		cloudConfig["write_files"] = append(writeFiles, map[string]string{
+			"path":        "/etc/modules-load.d/inaccel.conf",
+			"content":     strings.Join(modules, "\n") + "\n",
+			"permissions": "0644",
+		})
+		cloudConfig["runcmd"] = [][]string{
+			append([]string{"modprobe", "-a"}, modules...),
+		}
+	}
+	part, err := yaml.Marshal(cloudConfig)
+	if err != nil {
+		return err
+	}
+
+	var userData string
+	if raw, ok := cloudInitData["UserData"]; ok {
+		if err := json.Unmarshal(raw, &userData); err != nil {
+			return err
+		}
+	}
+	userData, err = appendUserData(userData, "#cloud-config\n"+string(part))
+	if err != nil {
+		return err
+	}
+	if cloudInitData["UserData"], err = json.Marshal(userData); err != nil {
+		return err
+	}
+
+	var configDriveMetaData map[string]json.RawMessage
+	if raw, ok := cloudInitData["ConfigDriveMetaData"]; ok {
+		if err := json.Unmarshal(raw, &configDriveMetaData); err != nil {
+			return err
+		}
+	}
+	if configDriveMetaData != nil {
+		var devices []deviceData
+		if raw, ok := configDriveMetaData["devices"]; ok {
+			if err := json.Unmarshal(raw, &devices); err != nil {
+				return err
+			}
+		}
+		for _, accelerator := range accelerators {
+			device := deviceData{
+				Type:    "hostdev",
+				Bus:     "pci",
+				Address: accelerator.Address,
+				Tags: []string{
+					accelerator.Resource,
+				},
+			}
+			if accelerator.NUMANode != nil {
+				device.NumaNode = uint32(*accelerator.NUMANode)
+			}
+			devices = append(devices, device)
+		}
+		if configDriveMetaData["devices"], err = json.Marshal(devices); err != nil {
+			return err
+		}
+		if cloudInitData["ConfigDriveMetaData"], err = json.Marshal(configDriveMetaData); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func appendUserData(userData, cloudConfig string) (string, error) {
+	if userData == "" {
+		return cloudConfig, nil
+	}
+
+	type part struct {
+		header textproto.MIMEHeader
+		body   []byte
+	}
+	var parts []part
+	if message, err := mail.ReadMessage(strings.NewReader(userData)); err == nil && strings.HasPrefix(message.Header.Get("Content-Type"), "multipart/") {
+		_, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+		if err != nil {
+			return "", err
+		}
+		reader := multipart.NewReader(message.Body, params["boundary"])
+		for {
+			multipartPart, err := reader.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			body, err := io.ReadAll(multipartPart)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, part{multipartPart.Header, body})
+		}
+	} else {
+		parts = append(parts, part{
+			textproto.MIMEHeader{
+				"Content-Type": {"text/plain; charset=\"utf-8\""},
+			},
+			[]byte(userData),
+		})
+	}
+	parts = append(parts, part{
+		textproto.MIMEHeader{
+			"Content-Type": {"text/cloud-config; charset=\"utf-8\""},
+			"Merge-Type":   {"list(append)+dict(recurse_array)+str()"},
+		},
+		[]byte(cloudConfig),
+	})
+
+	var b bytes.Buffer
+	writer := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%q\n", writer.Boundary())
+	fmt.Fprintf(&b, "MIME-Version: 1.0\n\n")
+	for _, part := range parts {
+		partWriter, err := writer.CreatePart(part.header)
+		if err != nil {
+			return "", err
+		}
+		if _, err := partWriter.Write(part.body); err != nil {
+			return "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
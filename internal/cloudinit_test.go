@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+type userDataPart struct {
+	contentType string
+	encoding    string
+	body        string
+}
+
+// readUserDataParts splits multipart user data back into its parts.
+func readUserDataParts(t *testing.T, userData string) []userDataPart {
+	t.Helper()
+	message, err := mail.ReadMessage(strings.NewReader(userData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("user data is %s, want multipart/mixed", mediaType)
+	}
+	var parts []userDataPart
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, userDataPart{
+			contentType: part.Header.Get("Content-Type"),
+			encoding:    part.Header.Get("Content-Transfer-Encoding"),
+			body:        string(body),
+		})
+	}
+	return parts
+}
+
+func TestAppendUserData(t *testing.T) {
+	const cloudConfig = "#cloud-config\nwrite_files: []\n"
+	appended := userDataPart{
+		contentType: `text/cloud-config; charset="utf-8"`,
+		body:        cloudConfig,
+	}
+
+	for _, test := range []struct {
+		name     string
+		userData string
+		parts    []userDataPart
+	}{
+		{
+			name:     "cloud-config",
+			userData: "#cloud-config\npackages:\n- pciutils\n",
+			parts: []userDataPart{
+				{contentType: `text/plain; charset="utf-8"`, body: "#cloud-config\npackages:\n- pciutils\n"},
+				appended,
+			},
+		},
+		{
+			name:     "script",
+			userData: "#!/bin/sh\necho hello\n",
+			parts: []userDataPart{
+				{contentType: `text/plain; charset="utf-8"`, body: "#!/bin/sh\necho hello\n"},
+				appended,
+			},
+		},
+		{
+			name: "multipart",
+			userData: "Content-Type: multipart/mixed; boundary=\"BOUNDARY\"\n" +
+				"MIME-Version: 1.0\n" +
+				"\n" +
+				"--BOUNDARY\n" +
+				"Content-Type: text/cloud-config\n" +
+				"\n" +
+				"#cloud-config\n" +
+				"users: []\n" +
+				"--BOUNDARY\n" +
+				"Content-Type: text/x-shellscript\n" +
+				"Content-Transfer-Encoding: base64\n" +
+				"\n" +
+				"IyEvYmluL3NoCmVjaG8gaGVsbG8K\n" +
+				"--BOUNDARY--\n",
+			parts: []userDataPart{
+				{contentType: "text/cloud-config", body: "#cloud-config\nusers: []"},
+				{contentType: "text/x-shellscript", encoding: "base64", body: "IyEvYmluL3NoCmVjaG8gaGVsbG8K"},
+				appended,
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			userData, err := appendUserData(test.userData, cloudConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parts := readUserDataParts(t, userData); !reflect.DeepEqual(parts, test.parts) {
+				t.Errorf("got parts %+v, want %+v", parts, test.parts)
+			}
+		})
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		userData, err := appendUserData("", cloudConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if userData != cloudConfig {
+			t.Errorf("got %q, want %q", userData, cloudConfig)
+		}
+	})
+}
+
+func TestInjectAccelerators(t *testing.T) {
+	numaNode := 1
+	accelerators := []accelerator{
+		{
+			Resource: "inaccel.com/fpga",
+			Slot:     "0000:3b:00.0",
+			Address:  "0000:01:00.0",
+			Vendor:   0x10ee,
+			Device:   0x5004,
+			NUMANode: &numaNode,
+		},
+	}
+
+	type writeFile struct {
+		Path        string `json:"path"`
+		Content     string `json:"content"`
+		Permissions string `json:"permissions"`
+	}
+	acceleratorsFile := writeFile{
+		Path: "/etc/inaccel/accelerators.json",
+		Content: `[
+	{
+		"resource": "inaccel.com/fpga",
+		"slot": "0000:3b:00.0",
+		"address": "0000:01:00.0",
+		"vendor": "10ee",
+		"device": "5004",
+		"numaNode": 1
+	}
+]
+`,
+		Permissions: "0644",
+	}
+
+	for _, test := range []struct {
+		name       string
+		modules    []string
+		writeFiles []writeFile
+		runcmd     [][]string
+	}{
+		{
+			name: "accelerators",
+			writeFiles: []writeFile{
+				acceleratorsFile,
+			},
+		},
+		{
+			name:    "modules",
+			modules: []string{"xocl", "xclmgmt"},
+			writeFiles: []writeFile{
+				acceleratorsFile,
+				{Path: "/etc/modules-load.d/inaccel.conf", Content: "xocl\nxclmgmt\n", Permissions: "0644"},
+			},
+			runcmd: [][]string{
+				{"modprobe", "-a", "xocl", "xclmgmt"},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cloudInitData := map[string]json.RawMessage{
+				"ConfigDriveMetaData": json.RawMessage(`{"instance_id":"vm","devices":[{"type":"nic","bus":"pci","address":"0000:02:01.0","mac":"02:00:00:00:00:01","tags":["default"]}]}`),
+			}
+			if err := injectAccelerators(cloudInitData, accelerators, test.modules); err != nil {
+				t.Fatal(err)
+			}
+
+			var userData string
+			if err := json.Unmarshal(cloudInitData["UserData"], &userData); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(userData, "#cloud-config\n") {
+				t.Errorf("user data does not start with #cloud-config:\n%s", userData)
+			}
+			var cloudConfig struct {
+				WriteFiles []writeFile `json:"write_files"`
+				Runcmd     [][]string  `json:"runcmd"`
+			}
+			if err := yaml.UnmarshalStrict([]byte(userData), &cloudConfig); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cloudConfig.WriteFiles, test.writeFiles) {
+				t.Errorf("got write_files %+v, want %+v", cloudConfig.WriteFiles, test.writeFiles)
+			}
+			if !reflect.DeepEqual(cloudConfig.Runcmd, test.runcmd) {
+				t.Errorf("got runcmd %q, want %q", cloudConfig.Runcmd, test.runcmd)
+			}
+
+			var configDriveMetaData struct {
+				InstanceID string       `json:"instance_id"`
+				Devices    []deviceData `json:"devices"`
+			}
+			if err := json.Unmarshal(cloudInitData["ConfigDriveMetaData"], &configDriveMetaData); err != nil {
+				t.Fatal(err)
+			}
+			if configDriveMetaData.InstanceID != "vm" {
+				t.Errorf("instance_id is %q, want vm", configDriveMetaData.InstanceID)
+			}
+			if expected := []deviceData{
+				{Type: "nic", Bus: "pci", Address: "0000:02:01.0", MAC: "02:00:00:00:00:01", Tags: []string{"default"}},
+				{Type: "hostdev", Bus: "pci", Address: "0000:01:00.0", NumaNode: 1, Tags: []string{"inaccel.com/fpga"}},
+			}; !reflect.DeepEqual(configDriveMetaData.Devices, expected) {
+				t.Errorf("got devices %+v, want %+v", configDriveMetaData.Devices, expected)
+			}
+		})
+	}
+
+	t.Run("no config drive", func(t *testing.T) {
+		cloudInitData := map[string]json.RawMessage{
+			"UserData": json.RawMessage(`"#cloud-config\n"`),
+		}
+		if err := injectAccelerators(cloudInitData, accelerators, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := cloudInitData["ConfigDriveMetaData"]; ok {
+			t.Error("ConfigDriveMetaData added to a NoCloud source")
+		}
+		var userData string
+		if err := json.Unmarshal(cloudInitData["UserData"], &userData); err != nil {
+			t.Fatal(err)
+		}
+		if parts := readUserDataParts(t, userData); len(parts) != 2 {
+			t.Errorf("got %d parts, want 2", len(parts))
+		}
+	})
+}
+
+func TestLauncherPod(t *testing.T) {
+	for _, test := range []struct {
+		vmi   string
+		pod   string
+		match bool
+	}{
+		{vmi: "vm", pod: "virt-launcher-vm-x7k2p", match: true},
+		{vmi: "vm", pod: "virt-launcher-vm-2-x7k2p"},
+		{vmi: "vm", pod: "virt-launcher-vm-x7k2"},
+		{vmi: "vm", pod: "virt-launcher-vm-x7k2pq"},
+		{vmi: "vm", pod: "virt-launcher-vm2-x7k2p"},
+		{vmi: "vm", pod: "virt-handler-vm-x7k2p"},
+		{vmi: strings.Repeat("a", 60), pod: "virt-launcher-" + strings.Repeat("a", 44) + "x7k2p", match: true},
+		{vmi: strings.Repeat("a", 60), pod: "virt-launcher-" + strings.Repeat("a", 43) + "-x7k2p"},
+	} {
+		t.Run(test.pod, func(t *testing.T) {
+			vmi := &kubevirtv1.VirtualMachineInstance{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: test.vmi,
+				},
+			}
+			if match := launcherPod(vmi, test.pod); match != test.match {
+				t.Errorf("launcherPod(%q, %q) = %t, want %t", test.vmi, test.pod, match, test.match)
+			}
+		})
+	}
+}
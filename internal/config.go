@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/inaccel/daemon/pkg/plugin"
+	"github.com/inaccel/device-selector/pkg/lspci"
+	"github.com/sirupsen/logrus"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+type Config struct {
+	Resources []ResourceConfig `json:"resources"`
+}
+
+type ResourceConfig struct {
+	ResourceName string   `json:"resourceName"`
+	Selector     string   `json:"selector"`
+	Mode         string   `json:"mode,omitempty"`
+	Unit         string   `json:"unit,omitempty"`
+	Driver       string   `json:"driver,omitempty"`
+	Modules      []string `json:"modules,omitempty"`
+	CDI          bool     `json:"cdi,omitempty"`
+	IOMMUFD      bool     `json:"iommufd,omitempty"`
+	NoIOMMU      bool     `json:"noiommu,omitempty"`
+	Prebind      bool     `json:"prebind,omitempty"`
+	Recover      bool     `json:"recover,omitempty"`
+}
+
+var selectorPattern = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{4}$`)
+
+func PciHostDeviceResource(pciHostDevice kubevirtv1.PciHostDevice) ResourceConfig {
+	return ResourceConfig{
+		ResourceName: pciHostDevice.ResourceName,
+		Selector:     pciHostDevice.PCIVendorSelector,
+	}
+}
+
+func ReadConfig(name string) (*Config, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(name, data)
+}
+
+func parseConfig(name string, data []byte) (*Config, error) {
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	resourceNames := map[string]int{}
+	selectors := map[string]int{}
+	for index, resource := range config.Resources {
+		if resource.ResourceName == "" {
+			return nil, fmt.Errorf("%s: resource %d: resourceName is required", name, index)
+		}
+		if !strings.Contains(resource.ResourceName, "/") {
+			return nil, fmt.Errorf("%s: resource %d: resourceName %q must be of the form <domain>/<name>", name, index, resource.ResourceName)
+		}
+		if other, ok := resourceNames[resource.ResourceName]; ok {
+			return nil, fmt.Errorf("%s: resource %d: resourceName %q is already used by resource %d", name, index, resource.ResourceName, other)
+		}
+		resourceNames[resource.ResourceName] = index
+		if !selectorPattern.MatchString(resource.Selector) {
+			return nil, fmt.Errorf("%s: resource %d: selector %q must be of the form <vendor>:<device> in lowercase hex, e.g. 10ee:5000", name, index, resource.Selector)
+		}
+		if other, ok := selectors[resource.Selector]; ok {
+			return nil, fmt.Errorf("%s: resource %d: selector %q is already used by resource %d", name, index, resource.Selector, other)
+		}
+		selectors[resource.Selector] = index
+		switch resource.Mode {
+		case "", "vm", "container":
+		default:
+			return nil, fmt.Errorf("%s: resource %d: mode %q must be vm or container", name, index, resource.Mode)
+		}
+		switch resource.Unit {
+		case "", functionUnit, slotUnit, iommuGroupUnit:
+		default:
+			return nil, fmt.Errorf("%s: resource %d: unit %q must be function, slot or iommuGroup", name, index, resource.Unit)
+		}
+		if strings.ContainsAny(resource.Driver, "/ ") {
+			return nil, fmt.Errorf("%s: resource %d: driver %q is not a valid driver name", name, index, resource.Driver)
+		}
+		if (resource.IOMMUFD || resource.NoIOMMU) && resource.driver() != "vfio-pci" {
+			return nil, fmt.Errorf("%s: resource %d: iommufd and noiommu require the vfio-pci driver", name, index)
+		}
+		if resource.Prebind && resource.driver() == "" {
+			return nil, fmt.Errorf("%s: resource %d: prebind requires a driver", name, index)
+		}
+		for _, module := range resource.Modules {
+			if module == "" || strings.ContainsAny(module, "/ ") {
+				return nil, fmt.Errorf("%s: resource %d: module %q is not a valid module name", name, index, module)
+			}
+		}
+	}
+	return config, nil
+}
+
+func matchResource(resources []ResourceConfig, pciDevice lspci.PCIDevice) (string, bool) {
+	for _, resource := range resources {
+		if resource.selects(pciDevice) {
+			return resource.ResourceName, true
+		}
+	}
+	return "", false
+}
+
+func (resource ResourceConfig) container() bool {
+	return resource.Mode == "container"
+}
+
+func (resource ResourceConfig) driver() string {
+	if resource.Driver == "" && !resource.container() {
+		return "vfio-pci"
+	}
+	return resource.Driver
+}
+
+func (resource ResourceConfig) modules() []string {
+	if resource.Modules == nil && resource.driver() == "vfio-pci" {
+		return []string{
+			"vfio_iommu_type1",
+			"vfio_pci",
+		}
+	}
+	return resource.Modules
+}
+
+type configWatcher struct {
+	ctx  context.Context
+	name string
+
+	new     func([]ResourceConfig) []plugin.New
+	plugins []plugin.Plugin
+	plugin.Plugin
+}
+
+func NewConfigWatcher(ctx context.Context, name string, new func([]ResourceConfig) []plugin.New) plugin.New {
+	return func() plugin.Plugin {
+		return newConfigWatcher(ctx, name, new)
+	}
+}
+
+func newConfigWatcher(ctx context.Context, name string, new func([]ResourceConfig) []plugin.New) plugin.Plugin {
+	ctx, cancel := context.WithCancel(ctx)
+
+	configWatcher := &configWatcher{
+		ctx:  ctx,
+		name: name,
+	}
+
+	configWatcher.new = new
+
+	configWatcher.Plugin = plugin.Base(func() {
+		defer configWatcher.stop()
+
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+		defer watcher.Close()
+
+		// Watch the directory, so that files replaced by rename (e.g.
+		// ConfigMap volumes) keep being followed.
+		if err := watcher.Add(filepath.Dir(name)); err != nil {
+			logrus.Error(err)
+			return
+		}
+
+		var data []byte
+		for {
+			if next, err := os.ReadFile(name); err != nil {
+				logrus.Error(err)
+			} else if data == nil || !bytes.Equal(data, next) {
+				if config, err := parseConfig(name, next); err != nil {
+					logrus.Error(err)
+				} else {
+					if data != nil {
+						logrus.Infof("%s: reloading %d resources", name, len(config.Resources))
+					}
+					configWatcher.stop()
+					configWatcher.start(config.Resources)
+				}
+				data = next
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-watcher.Errors:
+				logrus.Error(err)
+			case <-watcher.Events:
+			}
+		}
+	}, cancel)
+
+	return configWatcher
+}
+
+// start runs every plugin in its own goroutine, as plugin bodies block for as
+// long as they serve.
+func (watcher *configWatcher) start(resources []ResourceConfig) {
+	for _, new := range watcher.new(resources) {
+		plugin := new()
+		go plugin.Start()
+
+		watcher.plugins = append(watcher.plugins, plugin)
+	}
+}
+
+// stop waits for the plugins that serve a socket to exit, so that closing
+// their listener cannot unlink the socket of a replacement at the same path.
+func (watcher *configWatcher) stop() {
+	for _, plugin := range watcher.plugins {
+		plugin.Stop()
+	}
+	for _, plugin := range watcher.plugins {
+		if exited, ok := plugin.(interface{ wait(time.Duration) bool }); ok && !exited.wait(10*time.Second) {
+			logrus.Warnf("%s: plugin did not exit in time", watcher.name)
+		}
+	}
+	watcher.plugins = nil
+}
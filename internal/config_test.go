@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name: "valid",
+			config: `resources:
+- resourceName: inaccel.com/fpga
+  selector: 10ee:5004
+  unit: slot
+  iommufd: true
+- resourceName: inaccel.com/gpu
+  selector: 10de:1eb8
+  mode: container
+  driver: nvidia
+  prebind: true
+`,
+		},
+		{
+			name: "missing resource name",
+			config: `resources:
+- selector: 10ee:5004
+`,
+			err: "resource 0: resourceName is required",
+		},
+		{
+			name: "resource name without domain",
+			config: `resources:
+- resourceName: fpga
+  selector: 10ee:5004
+`,
+			err: `resource 0: resourceName "fpga" must be of the form <domain>/<name>`,
+		},
+		{
+			name: "duplicate resource name",
+			config: `resources:
+- resourceName: inaccel.com/fpga
+  selector: 10ee:5004
+- resourceName: inaccel.com/fpga
+  selector: 10ee:5005
+`,
+			err: `resource 1: resourceName "inaccel.com/fpga" is already used by resource 0`,
+		},
+		{
+			name: "uppercase selector",
+			config: `resources:
+- resourceName: inaccel.com/fpga
+  selector: 10EE:5004
+`,
+			err: `resource 0: selector "10EE:5004" must be of the form <vendor>:<device>`,
+		},
+		{
+			name: "selector without device",
+			config: `resources:
+- resourceName: inaccel.com/fpga
+  selector: 10ee
+`,
+			err: `resource 0: selector "10ee" must be of the form <vendor>:<device>`,
+		},
+		{
+			name: "unknown mode",
+			config: `resources:
+- resourceName: inaccel.com/fpga
+  selector: 10ee:5004
+  mode: vfio
+`,
+			err: `resource 0: mode "vfio" must be vm or container`,
+		},
+		{
+			name: "unknown unit",
+			config: `resources:
+- resourceName: inaccel.com/fpga
+  selector: 10ee:5004
+  unit: card
+`,
+			err: `resource 0: unit "card" must be function, slot or iommuGroup`,
+		},
+		{
+			name: "container mode with iommufd",
+			config: `resources:
+- resourceName: inaccel.com/fpga
+  selector: 10ee:5004
+  mode: container
+  iommufd: true
+`,
+			err: "resource 0: iommufd and noiommu require the vfio-pci driver",
+		},
+		{
+			name: "container mode with noiommu",
+			config: `resources:
+- resourceName: inaccel.com/fpga
+  selector: 10ee:5004
+  mode: container
+  driver: xocl
+  noiommu: true
+`,
+			err: "resource 0: iommufd and noiommu require the vfio-pci driver",
+		},
+		{
+			name: "container mode prebind without driver",
+			config: `resources:
+- resourceName: inaccel.com/fpga
+  selector: 10ee:5004
+  mode: container
+  prebind: true
+`,
+			err: "resource 0: prebind requires a driver",
+		},
+		{
+			name: "unknown field",
+			config: `resources:
+- resourceName: inaccel.com/fpga
+  selector: 10ee:5004
+  vfio: true
+`,
+			err: `unknown field "vfio"`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := parseConfig("config.yaml", []byte(test.config))
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if expected := []ResourceConfig{
+					{ResourceName: "inaccel.com/fpga", Selector: "10ee:5004", Unit: slotUnit, IOMMUFD: true},
+					{ResourceName: "inaccel.com/gpu", Selector: "10de:1eb8", Mode: "container", Driver: "nvidia", Prebind: true},
+				}; !reflect.DeepEqual(config.Resources, expected) {
+					t.Errorf("got resources %+v, want %+v", config.Resources, expected)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got %v, want an error containing %q", err, test.err)
+			}
+			if !strings.HasPrefix(err.Error(), "config.yaml: ") {
+				t.Errorf("error %q does not name the file", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+func IndentDomain(domainXML []byte) ([]byte, error) {
+	xml := etree.NewDocument()
+	if err := xml.ReadFromBytes(domainXML); err != nil {
+		return nil, err
+	}
+	xml.IndentTabs()
+	return xml.WriteToBytes()
+}
+
+func Diff(a, b []byte) string {
+	x := strings.SplitAfter(strings.TrimSuffix(string(a), "\n"), "\n")
+	y := strings.SplitAfter(strings.TrimSuffix(string(b), "\n"), "\n")
+
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var d strings.Builder
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			d.WriteString(" " + strings.TrimSuffix(x[i], "\n") + "\n")
+			i, j = i+1, j+1
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			d.WriteString("-" + strings.TrimSuffix(x[i], "\n") + "\n")
+			i++
+		default:
+			d.WriteString("+" + strings.TrimSuffix(y[j], "\n") + "\n")
+			j++
+		}
+	}
+	return d.String()
+}
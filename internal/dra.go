@@ -0,0 +1,409 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/inaccel/daemon/pkg/plugin"
+	"github.com/inaccel/device-selector/pkg/lspci"
+	"github.com/inaccel/device-selector/pkg/sysfs/bus/pci"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	corev1 "k8s.io/api/core/v1"
+	resourcev1beta1 "k8s.io/api/resource/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	drav1beta1 "k8s.io/kubelet/pkg/apis/dra/v1beta1"
+	pluginregistrationv1 "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// pcieRootAttribute is the standard attribute claims use to align devices
+// under the same root complex.
+const pcieRootAttribute = "resource.kubernetes.io/pcieRoot"
+
+type draPlugin struct {
+	ctx  context.Context
+	api  client.Client
+	node string
+	path string
+
+	driverName string
+	resources  []ResourceConfig
+	events     *EventRecorder
+	status     *serverStatus
+	exited
+	plugin.Plugin
+	drav1beta1.UnimplementedDRAPluginServer
+	pluginregistrationv1.UnimplementedRegistrationServer
+}
+
+func NewDRAPlugin(ctx context.Context, api client.Client, node, driverName string, resources []ResourceConfig, events *EventRecorder) plugin.New {
+	return func() plugin.Plugin {
+		return newDRAPlugin(ctx, api, node, driverName, resources, events)
+	}
+}
+
+func newDRAPlugin(ctx context.Context, api client.Client, node, driverName string, resources []ResourceConfig, events *EventRecorder) plugin.Plugin {
+	ctx, cancel := context.WithCancel(ctx)
+
+	draPlugin := &draPlugin{
+		ctx:  ctx,
+		api:  api,
+		node: node,
+		path: filepath.Join("/var/lib/kubelet/plugins_registry", driverName+".sock"),
+	}
+
+	draPlugin.driverName = driverName
+	draPlugin.resources = resources
+	draPlugin.events = events
+	draPlugin.exited = make(exited)
+
+	draPlugin.status = trackServer(draPlugin.path, driverName)
+
+	draPlugin.Plugin = plugin.Base(func() {
+		defer close(draPlugin.exited)
+
+		for _, resource := range resources {
+			if err := resource.probe(); err != nil {
+				logrus.Error(err)
+			}
+		}
+		go prebindLoop(ctx, resources, events, func() {})
+
+		go func() {
+			ticker := time.NewTicker(30 * time.Second)
+			defer ticker.Stop()
+
+			for {
+				if err := draPlugin.publish(); err != nil {
+					logrus.Error(err)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+
+		if listener, err := listen(draPlugin.path); err == nil {
+			go func() {
+				<-ctx.Done()
+
+				listener.Close()
+			}()
+
+			server := grpc.NewServer()
+			drav1beta1.RegisterDRAPluginServer(server, draPlugin)
+			pluginregistrationv1.RegisterRegistrationServer(server, draPlugin)
+
+			draPlugin.status.serve(ctx, func() {
+				server.Serve(listener)
+			})
+		} else {
+			logrus.Error(err)
+		}
+	}, cancel)
+
+	return draPlugin
+}
+
+// publish keeps the node's ResourceSlice in line with the devices the
+// resources select. The node name doubles as the pool name.
+func (plugin draPlugin) publish() error {
+	resourceSlice := &resourcev1beta1.ResourceSlice{}
+	if err := plugin.api.Get(plugin.ctx, client.ObjectKey{
+		Name: plugin.sliceName(),
+	}, resourceSlice); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		resourceSlice.Name = plugin.sliceName()
+	}
+
+	pciDevices := lspci.ListAll()
+	devices := []resourcev1beta1.Device{}
+	for _, resource := range plugin.resources {
+		for _, pciDevice := range resource.units(pciDevices) {
+			devices = append(devices, draDevice(resource, pciDevice))
+		}
+	}
+
+	if resourceSlice.CreationTimestamp.IsZero() {
+		resourceSlice.Spec = resourcev1beta1.ResourceSliceSpec{
+			Driver: plugin.driverName,
+			Pool: resourcev1beta1.ResourcePool{
+				Name:               plugin.node,
+				Generation:         1,
+				ResourceSliceCount: 1,
+			},
+			NodeName: plugin.node,
+			Devices:  devices,
+		}
+
+		return plugin.api.Create(plugin.ctx, resourceSlice)
+	} else if reflect.DeepEqual(resourceSlice.Spec.Devices, devices) {
+		return nil
+	}
+
+	resourceSlice.Spec.Pool.Generation++
+	resourceSlice.Spec.Devices = devices
+
+	return plugin.api.Update(plugin.ctx, resourceSlice)
+}
+
+func (plugin draPlugin) sliceName() string {
+	return plugin.node + "-" + strings.ReplaceAll(plugin.driverName, ".", "-")
+}
+
+// draDeviceName turns a slot into a device name, which has to be a DNS label:
+// 0000:03:00.0 becomes pci-0000-03-00-0.
+func draDeviceName(address pci.Address) string {
+	return "pci-" + strings.NewReplacer(":", "-", ".", "-").Replace(address.String())
+}
+
+func parseDRADeviceName(name string) (pci.Address, error) {
+	fields := strings.Split(strings.TrimPrefix(name, "pci-"), "-")
+	if len(fields) != 4 || !strings.HasPrefix(name, "pci-") {
+		return pci.Address{}, fmt.Errorf("invalid device name %q", name)
+	}
+	return pci.ParseAddress(fields[0] + ":" + fields[1] + ":" + fields[2] + "." + fields[3])
+}
+
+func draDevice(resource ResourceConfig, pciDevice lspci.PCIDevice) resourcev1beta1.Device {
+	attributes := map[resourcev1beta1.QualifiedName]resourcev1beta1.DeviceAttribute{
+		"resource": {StringValue: ptr.To(resource.ResourceName)},
+		"slot":     {StringValue: ptr.To(pciDevice.Slot.String())},
+		"vendor":   {StringValue: ptr.To(pciDevice.Vendor.String())},
+		"device":   {StringValue: ptr.To(pciDevice.Device.String())},
+	}
+	if pciDevice.SVendor != 0 || pciDevice.SDevice != 0 {
+		attributes["subsystemVendor"] = resourcev1beta1.DeviceAttribute{StringValue: ptr.To(pciDevice.SVendor.String())}
+		attributes["subsystemDevice"] = resourcev1beta1.DeviceAttribute{StringValue: ptr.To(pciDevice.SDevice.String())}
+	}
+	if pciDevice.NUMANode != nil {
+		attributes["numaNode"] = resourcev1beta1.DeviceAttribute{IntValue: ptr.To(int64(*pciDevice.NUMANode))}
+	}
+	if pciDevice.IOMMUGroup.Valid {
+		attributes["iommuGroup"] = resourcev1beta1.DeviceAttribute{IntValue: ptr.To(int64(pciDevice.IOMMUGroup.Number))}
+	}
+	if pcieRoot, err := pci.Device(pciDevice.Slot.String()).PCIeRoot(); err != nil {
+		logrus.Debug(err)
+	} else {
+		attributes[pcieRootAttribute] = resourcev1beta1.DeviceAttribute{StringValue: ptr.To(pcieRoot)}
+	}
+
+	return resourcev1beta1.Device{
+		Name: draDeviceName(pciDevice.Slot),
+		Basic: &resourcev1beta1.BasicDevice{
+			Attributes: attributes,
+		},
+	}
+}
+
+func (plugin draPlugin) GetInfo(ctx context.Context, request *pluginregistrationv1.InfoRequest) (*pluginregistrationv1.PluginInfo, error) {
+	response := &pluginregistrationv1.PluginInfo{
+		Type:     pluginregistrationv1.DRAPlugin,
+		Name:     plugin.driverName,
+		Endpoint: plugin.path,
+		SupportedVersions: []string{
+			drav1beta1.DRAPluginService,
+		},
+	}
+
+	return response, nil
+}
+
+func (plugin draPlugin) NodePrepareResources(ctx context.Context, request *drav1beta1.NodePrepareResourcesRequest) (*drav1beta1.NodePrepareResourcesResponse, error) {
+	response := &drav1beta1.NodePrepareResourcesResponse{
+		Claims: map[string]*drav1beta1.NodePrepareResourceResponse{},
+	}
+
+	for _, claim := range request.Claims {
+		devices, err := plugin.prepare(ctx, claim)
+		if err != nil {
+			plugin.events.nodeEvent(corev1.EventTypeWarning, "PrepareFailed", "Failed to prepare claim %s/%s: %v", claim.Namespace, claim.Name, err)
+
+			response.Claims[claim.UID] = &drav1beta1.NodePrepareResourceResponse{
+				Error: err.Error(),
+			}
+			continue
+		}
+		response.Claims[claim.UID] = &drav1beta1.NodePrepareResourceResponse{
+			Devices: devices,
+		}
+	}
+
+	return response, nil
+}
+
+func (plugin draPlugin) prepare(ctx context.Context, claim *drav1beta1.Claim) ([]*drav1beta1.Device, error) {
+	resourceClaim := &resourcev1beta1.ResourceClaim{}
+	if err := plugin.api.Get(ctx, client.ObjectKey{
+		Namespace: claim.Namespace,
+		Name:      claim.Name,
+	}, resourceClaim); err != nil {
+		return nil, err
+	}
+	if string(resourceClaim.UID) != claim.UID {
+		return nil, fmt.Errorf("claim %s/%s was replaced", claim.Namespace, claim.Name)
+	}
+	if resourceClaim.Status.Allocation == nil {
+		return nil, fmt.Errorf("claim %s/%s is not allocated", claim.Namespace, claim.Name)
+	}
+
+	var devices []*drav1beta1.Device
+	var devicesIDs []pci.Address
+	prepared := map[string]ResourceConfig{}
+	for _, result := range resourceClaim.Status.Allocation.Devices.Results {
+		if result.Driver != plugin.driverName || result.Pool != plugin.node {
+			continue
+		}
+		devicesID, err := parseDRADeviceName(result.Device)
+		if err != nil {
+			return nil, err
+		}
+		resource, pciDevices, err := plugin.lookup(devicesID)
+		if err != nil {
+			return nil, err
+		}
+		if err := resource.probe(); err != nil {
+			return nil, err
+		}
+		rebound, err := resource.ensureBound(resource.members(devicesID, pciDevices))
+		for _, pciDevice := range rebound {
+			plugin.events.nodeEvent(corev1.EventTypeNormal, "DriverRebound", "Rebound %s to %s for claim %s/%s", pciDevice.Slot, resource.driver(), claim.Namespace, claim.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		prepared[resource.ResourceName] = resource
+		devicesIDs = append(devicesIDs, devicesID)
+		devices = append(devices, &drav1beta1.Device{
+			RequestNames: []string{result.Request},
+			PoolName:     result.Pool,
+			DeviceName:   result.Device,
+			CDIDeviceIDs: []string{cdiDeviceName(resource.ResourceName, devicesID)},
+		})
+	}
+	for _, resource := range prepared {
+		if err := writeCDISpec(resource); err != nil {
+			return nil, err
+		}
+	}
+	// The claim may be gone by the time it is unprepared, so remember what
+	// it was prepared with.
+	if err := plugin.checkpoint(claim.UID, devicesIDs); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func (plugin draPlugin) NodeUnprepareResources(ctx context.Context, request *drav1beta1.NodeUnprepareResourcesRequest) (*drav1beta1.NodeUnprepareResourcesResponse, error) {
+	response := &drav1beta1.NodeUnprepareResourcesResponse{
+		Claims: map[string]*drav1beta1.NodeUnprepareResourceResponse{},
+	}
+
+	for _, claim := range request.Claims {
+		response.Claims[claim.UID] = &drav1beta1.NodeUnprepareResourceResponse{}
+		if err := plugin.unprepare(claim); err != nil {
+			plugin.events.nodeEvent(corev1.EventTypeWarning, "UnprepareFailed", "Failed to unprepare claim %s/%s: %v", claim.Namespace, claim.Name, err)
+
+			response.Claims[claim.UID].Error = err.Error()
+		}
+	}
+
+	return response, nil
+}
+
+func (plugin draPlugin) unprepare(claim *drav1beta1.Claim) error {
+	devicesIDs, err := plugin.readCheckpoint(claim.UID)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	for _, devicesID := range devicesIDs {
+		resource, pciDevices, err := plugin.lookup(devicesID)
+		if err != nil {
+			return err
+		}
+		// Prebound devices stay bound between claims.
+		if resource.Prebind {
+			continue
+		}
+		if err := restoreAll(resource.members(devicesID, pciDevices)); err != nil {
+			return err
+		}
+	}
+	return os.Remove(plugin.checkpointPath(claim.UID))
+}
+
+func (plugin draPlugin) checkpointPath(uid string) string {
+	return filepath.Join("/var/lib/kubelet/plugins", plugin.driverName, "claims", uid+".json")
+}
+
+func (plugin draPlugin) checkpoint(uid string, devicesIDs []pci.Address) error {
+	data, err := json.Marshal(devicesIDs)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(plugin.checkpointPath(uid)), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(plugin.checkpointPath(uid), data, 0644)
+}
+
+func (plugin draPlugin) readCheckpoint(uid string) ([]pci.Address, error) {
+	data, err := os.ReadFile(plugin.checkpointPath(uid))
+	if err != nil {
+		return nil, err
+	}
+	var devicesIDs []pci.Address
+	if err := json.Unmarshal(data, &devicesIDs); err != nil {
+		return nil, fmt.Errorf("%s: %w", plugin.checkpointPath(uid), err)
+	}
+	return devicesIDs, nil
+}
+
+func (plugin draPlugin) lookup(devicesID pci.Address) (ResourceConfig, []lspci.PCIDevice, error) {
+	pciDevices := lspci.ListAll()
+	for _, pciDevice := range pciDevices {
+		if pciDevice.Slot != devicesID {
+			continue
+		}
+		for _, resource := range plugin.resources {
+			if resource.selects(pciDevice) {
+				return resource, pciDevices, nil
+			}
+		}
+		return ResourceConfig{}, nil, fmt.Errorf("%s: not managed by %s", devicesID, plugin.driverName)
+	}
+	return ResourceConfig{}, nil, fmt.Errorf("%s: no such device", devicesID)
+}
+
+func (plugin draPlugin) NotifyRegistrationStatus(ctx context.Context, request *pluginregistrationv1.RegistrationStatus) (*pluginregistrationv1.RegistrationStatusResponse, error) {
+	response := &pluginregistrationv1.RegistrationStatusResponse{}
+
+	plugin.status.registered.Store(request.PluginRegistered)
+	if request.PluginRegistered {
+		pluginRegistered.WithLabelValues(plugin.driverName).Set(1)
+	} else {
+		pluginRegistered.WithLabelValues(plugin.driverName).Set(0)
+
+		logrus.Error(request.Error)
+	}
+
+	return response, nil
+}
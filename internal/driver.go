@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/inaccel/device-selector/pkg/lspci"
+	"github.com/inaccel/device-selector/pkg/modalias"
+	"github.com/inaccel/device-selector/pkg/sysfs/bus/pci"
+	"github.com/u-root/u-root/pkg/kmodule"
+)
+
+// Modules are loaded at most once, and never when built into the kernel.
+var loadedModules sync.Map
+
+const originalDriversDir = "/run/device-selector/original-drivers"
+
+func (resource ResourceConfig) probe() error {
+	for _, module := range resource.targetModules() {
+		if _, ok := loadedModules.Load(module); ok {
+			continue
+		}
+		if !modalias.Builtin(module) && !modalias.Loaded(module) {
+			if err := kmodule.Probe(module, ""); err != nil {
+				return err
+			}
+		}
+		loadedModules.Store(module, nil)
+	}
+	if resource.driver() == "vfio-pci" && resource.noIOMMU() {
+		return enableNoIOMMU()
+	}
+	return nil
+}
+
+// targetModules returns the modules of the target driver: the configured or
+// vfio ones, or else the module named after the driver among those the
+// selected devices resolve to through their modalias.
+func (resource ResourceConfig) targetModules() []string {
+	if modules := resource.modules(); modules != nil {
+		return modules
+	}
+	driver := resource.driver()
+	if driver == "" {
+		return nil
+	}
+	if _, err := os.Stat(pci.Driver(driver).Path()); err == nil {
+		return nil
+	}
+	for _, pciDevice := range lspci.ListAll() {
+		if resource.selects(pciDevice) && slices.Contains(hostModules(pciDevice), modalias.Name(driver)) {
+			return []string{modalias.Name(driver)}
+		}
+	}
+	return nil
+}
+
+// hostModules returns the modules that would normally claim the device.
+func hostModules(pciDevice lspci.PCIDevice) []string {
+	alias, err := pci.Device(pciDevice.Slot.String()).Modalias()
+	if err != nil {
+		return nil
+	}
+	modules, err := modalias.Resolve(alias)
+	if err != nil {
+		return nil
+	}
+	return modules
+}
+
+func (resource ResourceConfig) bind(pciDevice lspci.PCIDevice) (bool, error) {
+	driver := resource.driver()
+	if driver == "" {
+		if pciDevice.Driver == "" {
+			return false, fmt.Errorf("%s: no driver bound", pciDevice.Slot)
+		}
+		return false, nil
+	}
+	if pciDevice.Driver == driver {
+		return false, nil
+	}
+
+	if err := recordOriginalDriver(pciDevice.Slot, pciDevice.Driver); err != nil {
+		return false, err
+	}
+
+	if err := pci.Device(pciDevice.Slot.String()).Rebind(pci.Driver(driver), observeDriverOperation); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// bindAll binds the devices under their locks, in parallel across lock
+// groups, and returns the ones that were rebound with their previous driver.
+func (resource ResourceConfig) bindAll(pciDevices []lspci.PCIDevice) ([]lspci.PCIDevice, error) {
+	unlock, err := lockDevices(pciDevices)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var mu sync.Mutex
+	var rebound []lspci.PCIDevice
+	err = forEachLockGroup(pciDevices, func(pciDevice lspci.PCIDevice) error {
+		pciDevice = currentDriver(pciDevice)
+		ok, err := resource.bind(pciDevice)
+		if ok {
+			mu.Lock()
+			rebound = append(rebound, pciDevice)
+			mu.Unlock()
+		}
+		return err
+	})
+	slices.SortFunc(rebound, func(a, b lspci.PCIDevice) int {
+		return a.Slot.Compare(b.Slot)
+	})
+	return rebound, err
+}
+
+// currentDriver refreshes the driver of a device listed before its lock was
+// taken.
+func currentDriver(pciDevice lspci.PCIDevice) lspci.PCIDevice {
+	pciDevice.Driver = ""
+	if driver, err := pci.Device(pciDevice.Slot.String()).Driver(); err == nil {
+		pciDevice.Driver = filepath.Base(driver)
+	}
+	return pciDevice
+}
+
+func restore(pciDevice lspci.PCIDevice) error {
+	originalDriver, ok, err := readOriginalDriver(pciDevice.Slot)
+	if err != nil || !ok {
+		return err
+	}
+
+	device := pci.Device(pciDevice.Slot.String())
+	if pciDevice.Driver != originalDriver {
+		if err := device.Rebind(pci.Driver(originalDriver), observeDriverOperation); err != nil {
+			return err
+		}
+	}
+	if override, err := device.ReadDriverOverride(); err != nil {
+		return err
+	} else if override != "" {
+		if err := device.ClearDriverOverride(); err != nil {
+			return err
+		}
+	}
+	return forgetOriginalDriver(pciDevice.Slot)
+}
+
+// recordOriginalDriver keeps the driver a device was bound to before it was
+// first rebound in a file per device under originalDriversDir, so that restore
+// still finds it after the daemon restarts. Callers hold the device lock.
+func recordOriginalDriver(address pci.Address, driver string) error {
+	name := filepath.Join(originalDriversDir, address.String())
+	if _, err := os.Stat(name); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(originalDriversDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(name, []byte(driver+"\n"), 0644)
+}
+
+// readOriginalDriver returns the recorded original driver of a device, which
+// is empty for devices that had none.
+func readOriginalDriver(address pci.Address) (string, bool, error) {
+	data, err := os.ReadFile(filepath.Join(originalDriversDir, address.String()))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return strings.TrimSpace(string(data)), true, nil
+}
+
+func forgetOriginalDriver(address pci.Address) error {
+	if err := os.Remove(filepath.Join(originalDriversDir, address.String())); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func restoreAll(pciDevices []lspci.PCIDevice) error {
+	unlock, err := lockDevices(pciDevices)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return forEachLockGroup(pciDevices, func(pciDevice lspci.PCIDevice) error {
+		return restore(currentDriver(pciDevice))
+	})
+}
+
+func (resource ResourceConfig) vfioDevices(pciDevices []lspci.PCIDevice) []string {
+	iommufd := false
+	if resource.IOMMUFD {
+		if _, err := os.Stat("/dev/iommu"); err == nil {
+			iommufd = true
+		}
+	}
+
+	var paths []string
+	var cdev, group bool
+	for _, pciDevice := range pciDevices {
+		if iommufd {
+			if vfioDev, err := pci.Device(pciDevice.Slot.String()).VfioDev(); err == nil {
+				paths = append(paths, filepath.Join("/dev/vfio/devices", vfioDev))
+				cdev = true
+				continue
+			}
+		}
+		// Read the group back, as vfio only creates no-IOMMU groups on bind.
+		if iommuGroup, err := pci.Device(pciDevice.Slot.String()).IommuGroup(); err == nil {
+			path := filepath.Join("/dev/vfio", filepath.Base(iommuGroup))
+			if _, err := os.Stat(filepath.Join("/dev/vfio", "noiommu-"+filepath.Base(iommuGroup))); err == nil {
+				path = filepath.Join("/dev/vfio", "noiommu-"+filepath.Base(iommuGroup))
+			}
+			if !slices.Contains(paths, path) {
+				paths = append(paths, path)
+			}
+			group = true
+		}
+	}
+	if cdev {
+		paths = append(paths, "/dev/iommu")
+	}
+	if group || !cdev {
+		paths = append(paths, "/dev/vfio/vfio")
+	}
+	return paths
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type EventRecorder struct {
+	api  client.Client
+	node string
+}
+
+func NewEventRecorder(api client.Client, node string) *EventRecorder {
+	return &EventRecorder{
+		api:  api,
+		node: node,
+	}
+}
+
+func (recorder *EventRecorder) nodeEvent(eventType, reason, format string, a ...any) {
+	if recorder == nil {
+		return
+	}
+
+	recorder.event(corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Node",
+		Name:       recorder.node,
+		UID:        types.UID(recorder.node),
+	}, eventType, reason, fmt.Sprintf(format, a...))
+}
+
+func (recorder *EventRecorder) podEvent(resource string, devicesIDs []string, eventType, reason, format string, a ...any) {
+	if recorder == nil {
+		return
+	}
+
+	message := fmt.Sprintf(format, a...)
+	go func() {
+		for attempt := 0; attempt < 10; attempt++ {
+			time.Sleep(time.Second)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			podResources, err := findPodResources(ctx, resource, devicesIDs)
+			cancel()
+			if err != nil {
+				logrus.Debug(err)
+				continue
+			}
+			if podResources == nil {
+				continue
+			}
+
+			pod := &corev1.Pod{}
+			if err := recorder.api.Get(context.Background(), client.ObjectKey{
+				Namespace: podResources.Namespace,
+				Name:      podResources.Name,
+			}, pod); err != nil {
+				logrus.Debug(err)
+				return
+			}
+			recorder.event(corev1.ObjectReference{
+				APIVersion: "v1",
+				Kind:       "Pod",
+				Namespace:  pod.Namespace,
+				Name:       pod.Name,
+				UID:        pod.UID,
+			}, eventType, reason, message)
+			return
+		}
+	}()
+}
+
+func (recorder *EventRecorder) objectEvent(object corev1.ObjectReference, eventType, reason, format string, a ...any) {
+	if recorder == nil {
+		return
+	}
+
+	recorder.event(object, eventType, reason, fmt.Sprintf(format, a...))
+}
+
+func (recorder *EventRecorder) event(object corev1.ObjectReference, eventType, reason, message string) {
+	namespace := object.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	now := metav1.Now()
+
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", object.Name, now.UnixNano()),
+			Namespace: namespace,
+		},
+		InvolvedObject: object,
+		Reason:         reason,
+		Message:        message,
+		Source: corev1.EventSource{
+			Component: "device-selector",
+			Host:      recorder.node,
+		},
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		Type:                eventType,
+		ReportingController: "inaccel.com/device-selector",
+		ReportingInstance:   recorder.node,
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := recorder.api.Create(ctx, event); err != nil {
+			logrus.Debug(err)
+		}
+	}()
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type serverStatus struct {
+	path     string
+	resource string
+
+	serving    atomic.Bool
+	registered atomic.Bool
+}
+
+var servers sync.Map
+
+func trackServer(path, resource string) *serverStatus {
+	status := &serverStatus{
+		path:     path,
+		resource: resource,
+	}
+	servers.Store(path, status)
+	return status
+}
+
+func (status *serverStatus) serve(ctx context.Context, serve func()) {
+	status.serving.Store(true)
+	serve()
+	status.serving.Store(false)
+
+	if ctx.Err() != nil {
+		servers.CompareAndDelete(status.path, status)
+	}
+}
+
+func (status *serverStatus) alive() error {
+	if !status.serving.Load() {
+		return fmt.Errorf("%s: not serving", status.path)
+	}
+	conn, err := net.DialTimeout("unix", status.path, time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (status *serverStatus) ready() error {
+	if err := status.alive(); err != nil {
+		return err
+	}
+	if status.resource != "" && !status.registered.Load() {
+		return fmt.Errorf("%s: not registered", status.resource)
+	}
+	return nil
+}
+
+func checkServers(check func(*serverStatus) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var errs []string
+		servers.Range(func(_, status any) bool {
+			if err := check(status.(*serverStatus)); err != nil {
+				errs = append(errs, err.Error())
+			}
+			return true
+		})
+		if len(errs) > 0 {
+			http.Error(w, strings.Join(errs, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+func ServeHealth(ctx context.Context, address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", checkServers((*serverStatus).alive))
+	mux.Handle("/readyz", checkServers((*serverStatus).ready))
+
+	return serve(ctx, address, mux)
+}
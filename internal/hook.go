@@ -2,17 +2,20 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/beevik/etree"
 	"github.com/inaccel/daemon/pkg/plugin"
 	"github.com/inaccel/device-selector/pkg/lspci"
+	"github.com/inaccel/device-selector/pkg/sysfs/bus/pci"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
 	"kubevirt.io/kubevirt/pkg/hooks/info"
 	kubevirthooksv1alpha2 "kubevirt.io/kubevirt/pkg/hooks/v1alpha2"
 )
@@ -21,23 +24,40 @@ type hook struct {
 	ctx  context.Context
 	path string
 
+	policy     string
+	config     string
+	events     *EventRecorder
+	hookPoints []string
 	plugin.Plugin
 }
 
-func NewHook(ctx context.Context) plugin.New {
+func NewHook(ctx context.Context, name, policy, config string, events *EventRecorder, hookPoints ...string) plugin.New {
 	return func() plugin.Plugin {
-		return newHook(ctx)
+		return newHook(ctx, name, policy, config, events, hookPoints...)
 	}
 }
 
-func newHook(ctx context.Context) plugin.Plugin {
+func newHook(ctx context.Context, name, policy, config string, events *EventRecorder, hookPoints ...string) plugin.Plugin {
 	ctx, cancel := context.WithCancel(ctx)
 
 	hook := &hook{
 		ctx:  ctx,
-		path: filepath.Join("/var/run/kubevirt-hooks/inaccel.sock"),
+		path: filepath.Join("/var/run/kubevirt-hooks", name),
 	}
 
+	hook.policy = policy
+	hook.config = config
+	hook.events = events
+	hook.hookPoints = hookPoints
+	if len(hook.hookPoints) == 0 {
+		hook.hookPoints = []string{
+			info.OnDefineDomainHookPointName,
+			info.PreCloudInitIsoHookPointName,
+		}
+	}
+
+	status := trackServer(hook.path, "")
+
 	hook.Plugin = plugin.Base(func() {
 		if listener, err := listen(hook.path); err == nil {
 			go func() {
@@ -50,7 +70,9 @@ func newHook(ctx context.Context) plugin.Plugin {
 			kubevirthooksv1alpha2.RegisterCallbacksServer(server, hook)
 			info.RegisterInfoServer(server, hook)
 
-			server.Serve(listener)
+			status.serve(ctx, func() {
+				server.Serve(listener)
+			})
 		} else {
 			logrus.Error(err)
 		}
@@ -62,68 +84,243 @@ func newHook(ctx context.Context) plugin.Plugin {
 func (hook hook) Info(ctx context.Context, params *info.InfoParams) (*info.InfoResult, error) {
 	result := &info.InfoResult{
 		Name: "inaccel",
-		HookPoints: []*info.HookPoint{
-			{
-				Name: info.OnDefineDomainHookPointName,
-			},
-		},
 		Versions: []string{
 			"v1alpha2",
 		},
 	}
 
+	for _, hookPoint := range hook.hookPoints {
+		result.HookPoints = append(result.HookPoints, &info.HookPoint{
+			Name: hookPoint,
+		})
+	}
+
 	return result, nil
 }
 
 func (hook hook) OnDefineDomain(ctx context.Context, params *kubevirthooksv1alpha2.OnDefineDomainParams) (*kubevirthooksv1alpha2.OnDefineDomainResult, error) {
 	result := &kubevirthooksv1alpha2.OnDefineDomainResult{}
 
-	xml := etree.NewDocument()
-	if err := xml.ReadFromBytes(params.DomainXML); err != nil {
+	hookInvocations.WithLabelValues(info.OnDefineDomainHookPointName).Inc()
+
+	var allocated map[pci.Address]bool
+	vmi := &kubevirtv1.VirtualMachineInstance{}
+	if err := json.Unmarshal(params.Vmi, vmi); err == nil && CheckPodResources() == nil {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		allocated, err = otherPodDevices(ctx, vmi)
+		cancel()
+		if err != nil {
+			logrus.Debug(err)
+		}
+	}
+
+	domainXML, rewrites, err := renderDomain(params.DomainXML, params.Vmi, hook.policy, hook.config, lspci.ListAll(), allocated)
+	if err != nil {
+		hook.events.nodeEvent(corev1.EventTypeWarning, "DomainRewriteFailed", "Failed to rewrite domain: %v", err)
+
+		if vmi.UID != "" {
+			hook.events.objectEvent(corev1.ObjectReference{
+				APIVersion: kubevirtv1.GroupVersion.String(),
+				Kind:       "VirtualMachineInstance",
+				Namespace:  vmi.Namespace,
+				Name:       vmi.Name,
+				UID:        vmi.UID,
+			}, corev1.EventTypeWarning, "DomainRewriteFailed", "Failed to rewrite domain: %v", err)
+		}
+
 		return nil, err
 	}
-	for index, hostdev := range xml.FindElements("domain/devices/hostdev") {
+	result.DomainXML = domainXML
+
+	hookRewrites.Add(float64(rewrites))
+
+	return result, nil
+}
+
+func RenderDomain(domainXML, vmiJSON []byte, policy, config string, pciDevices []lspci.PCIDevice) ([]byte, error) {
+	domainXML, _, err := renderDomain(domainXML, vmiJSON, policy, config, pciDevices, nil)
+	return domainXML, err
+}
+
+// renderDomain rewrites the host devices of the domain. Devices in allocated
+// belong to other pods and are never pulled in through IOMMU group expansion.
+func renderDomain(domainXML, vmiJSON []byte, policy, config string, pciDevices []lspci.PCIDevice, allocated map[pci.Address]bool) ([]byte, int, error) {
+	vmi := &kubevirtv1.VirtualMachineInstance{}
+	if len(vmiJSON) > 0 {
+		if err := json.Unmarshal(vmiJSON, vmi); err != nil {
+			return nil, 0, err
+		}
+	}
+	resources := hostDeviceResources(vmi)
+
+	policies, err := readHostDevicePolicies(policy)
+	if err != nil {
+		return nil, 0, err
+	}
+	units, err := readResourceUnits(config)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	xml := etree.NewDocument()
+	if err := xml.ReadFromBytes(domainXML); err != nil {
+		return nil, 0, err
+	}
+	assigned := map[pci.Address]bool{}
+	for _, address := range xml.FindElements("domain/devices/hostdev[@type='pci']/source/address") {
+		source, err := sourceAddress(address)
+		if err != nil {
+			return nil, 0, err
+		}
+		assigned[source] = true
+	}
+	for address := range allocated {
+		assigned[address] = true
+	}
+	// Host devices that are not part of the VMI, such as SR-IOV interfaces,
+	// are placed on the buses after those of the VMI.
+	buses := guestBuses(vmi)
+	next := uint8(len(buses))
+	var rewrites int
+	for _, hostdev := range xml.FindElements("domain/devices/hostdev") {
 		if hostdev.SelectAttrValue("type", "") == "pci" && hostdev.FindElement("address") == nil {
-			domain := strings.TrimPrefix(hostdev.FindElement("source/address").SelectAttrValue("domain", ""), "0x")
-			bus := strings.TrimPrefix(hostdev.FindElement("source/address").SelectAttrValue("bus", ""), "0x")
-			slot := strings.TrimPrefix(hostdev.FindElement("source/address").SelectAttrValue("slot", ""), "0x")
-
-			for _, pciDevice := range lspci.ListAll() {
-				if strings.HasPrefix(pciDevice.Slot, fmt.Sprintf("%s:%s:%s.", domain, bus, slot)) {
-					function := strings.TrimPrefix(pciDevice.Slot, fmt.Sprintf("%s:%s:%s.", domain, bus, slot))
-
-					hostdevCopy := hostdev.Copy()
-
-					address := hostdevCopy.CreateElement("address")
-					address.CreateAttr("type", "pci")
-					address.CreateAttr("domain", "0x0000")
-					address.CreateAttr("bus", fmt.Sprintf("0x%02x", index+1))
-					address.CreateAttr("slot", "0x00")
-					address.CreateAttr("function", "0x"+function)
-					if function == "0" {
-						address.CreateAttr("multifunction", "on")
-					}
+			alias := hostdev.FindElement("alias").SelectAttrValue("name", "")
+			resource := resources[alias]
+			bus, ok := buses[alias]
+			if !ok {
+				next++
+				bus = next
+			}
 
-					hostdevCopy.FindElement("alias").CreateAttr("name", hostdevCopy.FindElement("alias").SelectAttrValue("name", "")+"-"+function)
+			source, err := sourceAddress(hostdev.FindElement("source/address"))
+			if err != nil {
+				return nil, 0, err
+			}
+			members, err := hostdevMembers(source, resource, units.of(resource), policies, pciDevices, assigned)
+			if err != nil {
+				return nil, 0, err
+			}
+			for _, member := range members {
+				hostdevCopy := hostdev.Copy()
 
-					hostdevCopy.FindElement("source/address").CreateAttr("function", "0x"+function)
+				address := hostdevCopy.CreateElement("address")
+				address.CreateAttr("type", "pci")
+				address.CreateAttr("domain", "0x0000")
+				address.CreateAttr("bus", fmt.Sprintf("0x%02x", bus))
+				address.CreateAttr("slot", "0x00")
+				address.CreateAttr("function", fmt.Sprintf("0x%x", member.function))
+				if member.function == 0 {
+					address.CreateAttr("multifunction", "on")
+				}
+
+				hostdevCopy.FindElement("alias").CreateAttr("name", fmt.Sprintf("%s-%d", hostdevCopy.FindElement("alias").SelectAttrValue("name", ""), member.function))
+
+				hostdevCopy.FindElement("source/address").CreateAttr("domain", fmt.Sprintf("0x%04x", member.pciDevice.Slot.Domain))
+				hostdevCopy.FindElement("source/address").CreateAttr("bus", fmt.Sprintf("0x%02x", member.pciDevice.Slot.Bus))
+				hostdevCopy.FindElement("source/address").CreateAttr("slot", fmt.Sprintf("0x%02x", member.pciDevice.Slot.Device))
+				hostdevCopy.FindElement("source/address").CreateAttr("function", fmt.Sprintf("0x%x", member.pciDevice.Slot.Function))
 
-					xml.FindElement("domain/devices").InsertChildAt(hostdev.Index(), hostdevCopy)
+				for _, policy := range policies {
+					if policy.matches(resource, member.pciDevice) {
+						policy.apply(hostdevCopy)
+					}
 				}
+
+				xml.FindElement("domain/devices").InsertChildAt(hostdev.Index(), hostdevCopy)
 			}
 			xml.FindElement("domain/devices").RemoveChild(hostdev)
+
+			rewrites++
 		}
 	}
 	xml.IndentTabs()
-	domainXML, err := xml.WriteToBytes()
+	domainXML, err = xml.WriteToBytes()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	result.DomainXML = domainXML
+	return domainXML, rewrites, nil
+}
 
-	return result, nil
+func sourceAddress(address *etree.Element) (pci.Address, error) {
+	return pci.ParseLibvirtAddress(
+		address.SelectAttrValue("domain", ""),
+		address.SelectAttrValue("bus", ""),
+		address.SelectAttrValue("slot", ""),
+		address.SelectAttrValue("function", ""),
+	)
 }
 
 func (hook hook) PreCloudInitIso(ctx context.Context, params *kubevirthooksv1alpha2.PreCloudInitIsoParams) (*kubevirthooksv1alpha2.PreCloudInitIsoResult, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	result := &kubevirthooksv1alpha2.PreCloudInitIsoResult{
+		CloudInitData:          params.CloudInitData,
+		CloudInitNoCloudSource: params.CloudInitNoCloudSource,
+	}
+
+	hookInvocations.WithLabelValues(info.PreCloudInitIsoHookPointName).Inc()
+
+	vmi := &kubevirtv1.VirtualMachineInstance{}
+	if err := json.Unmarshal(params.Vmi, vmi); err != nil {
+		return nil, err
+	}
+	var cloudInitData map[string]json.RawMessage
+	if err := json.Unmarshal(params.CloudInitData, &cloudInitData); err != nil {
+		return nil, err
+	}
+	if cloudInitData == nil {
+		return result, nil
+	}
+
+	policies, err := readHostDevicePolicies(hook.policy)
+	if err != nil {
+		return nil, err
+	}
+	units, err := readResourceUnits(hook.config)
+	if err != nil {
+		return nil, err
+	}
+
+	accelerators, err := listAccelerators(ctx, vmi, policies, units)
+	if err != nil {
+		logrus.Error(err)
+
+		return result, nil
+	}
+	if len(accelerators) == 0 {
+		return result, nil
+	}
+
+	var modules []string
+	if value, ok := vmi.Annotations[modulesAnnotation]; ok {
+		for _, module := range strings.Split(value, ",") {
+			if module = strings.TrimSpace(module); module != "" {
+				modules = append(modules, module)
+			}
+		}
+	}
+	if err := injectAccelerators(cloudInitData, accelerators, modules); err != nil {
+		return nil, err
+	}
+
+	cloudInitDataJSON, err := json.Marshal(cloudInitData)
+	if err != nil {
+		return nil, err
+	}
+	result.CloudInitData = cloudInitDataJSON
+
+	cloudInitNoCloudSource := kubevirtv1.CloudInitNoCloudSource{}
+	if len(result.CloudInitNoCloudSource) > 0 {
+		if err := json.Unmarshal(result.CloudInitNoCloudSource, &cloudInitNoCloudSource); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(cloudInitData["UserData"], &cloudInitNoCloudSource.UserData); err != nil {
+		return nil, err
+	}
+	cloudInitNoCloudSourceJSON, err := json.Marshal(cloudInitNoCloudSource)
+	if err != nil {
+		return nil, err
+	}
+	result.CloudInitNoCloudSource = cloudInitNoCloudSourceJSON
+
+	return result, nil
 }
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/inaccel/device-selector/pkg/lspci"
+	"github.com/inaccel/device-selector/pkg/sysfs/bus/pci"
+	"sigs.k8s.io/yaml"
+)
+
+var update = flag.Bool("update", false, "update the golden files under testdata")
+
+// TestRenderDomain renders testdata/render/*/domain.xml with the policy, VMI,
+// inventory, and optional config and allocated devices next to it, and
+// compares the result with expected.xml.
+func TestRenderDomain(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("testdata", "render", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			domainXML, err := os.ReadFile(filepath.Join(dir, "domain.xml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			vmiYAML, err := os.ReadFile(filepath.Join(dir, "vmi.yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			vmiJSON, err := yaml.YAMLToJSON(vmiYAML)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inventory, err := os.ReadFile(filepath.Join(dir, "inventory.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pciDevices []lspci.PCIDevice
+			if err := json.Unmarshal(inventory, &pciDevices); err != nil {
+				t.Fatal(err)
+			}
+			var allocated map[pci.Address]bool
+			if data, err := os.ReadFile(filepath.Join(dir, "allocated.json")); err == nil {
+				var addresses []pci.Address
+				if err := json.Unmarshal(data, &addresses); err != nil {
+					t.Fatal(err)
+				}
+				allocated = map[pci.Address]bool{}
+				for _, address := range addresses {
+					allocated[address] = true
+				}
+			}
+			var config string
+			if _, err := os.Stat(filepath.Join(dir, "config.yaml")); err == nil {
+				config = filepath.Join(dir, "config.yaml")
+			}
+
+			renderedDomainXML, _, err := renderDomain(domainXML, vmiJSON, filepath.Join(dir, "policy.yaml"), config, pciDevices, allocated)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join(dir, "expected.xml")
+			if *update {
+				if err := os.WriteFile(golden, renderedDomainXML, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expectedDomainXML, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(renderedDomainXML, expectedDomainXML) {
+				t.Errorf("rendered domain differs from %s:\n%s", golden, Diff(expectedDomainXML, renderedDomainXML))
+			}
+		})
+	}
+}
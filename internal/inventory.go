@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/inaccel/daemon/pkg/plugin"
+	"github.com/inaccel/device-selector/pkg/apis/v1alpha1"
+	"github.com/inaccel/device-selector/pkg/lspci"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var deviceHealth sync.Map
+
+type deviceInventoryPublisher struct {
+	ctx  context.Context
+	api  client.Client
+	node string
+
+	resources []ResourceConfig
+	plugin.Plugin
+}
+
+func NewDeviceInventoryPublisher(ctx context.Context, api client.Client, node string, resources []ResourceConfig) plugin.New {
+	return func() plugin.Plugin {
+		return newDeviceInventoryPublisher(ctx, api, node, resources)
+	}
+}
+
+func newDeviceInventoryPublisher(ctx context.Context, api client.Client, node string, resources []ResourceConfig) plugin.Plugin {
+	ctx, cancel := context.WithCancel(ctx)
+
+	deviceInventoryPublisher := &deviceInventoryPublisher{
+		ctx:  ctx,
+		api:  api,
+		node: node,
+	}
+
+	deviceInventoryPublisher.resources = resources
+
+	deviceInventoryPublisher.Plugin = plugin.Base(func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			if err := deviceInventoryPublisher.publish(); err != nil {
+				logrus.Error(err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}, cancel)
+
+	return deviceInventoryPublisher
+}
+
+func (publisher deviceInventoryPublisher) publish() error {
+	deviceInventory := &v1alpha1.DeviceInventory{}
+	if err := publisher.api.Get(publisher.ctx, client.ObjectKey{
+		Name: publisher.node,
+	}, deviceInventory); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		deviceInventory.Name = publisher.node
+	}
+
+	allocations := map[string]*v1alpha1.Allocation{}
+	ctx, cancel := context.WithTimeout(publisher.ctx, 5*time.Second)
+	response, err := listPodResources(ctx)
+	cancel()
+	if err != nil {
+		logrus.Debug(err)
+	} else {
+		for _, podResources := range response.PodResources {
+			for _, containerResources := range podResources.Containers {
+				for _, containerDevices := range containerResources.Devices {
+					for _, deviceID := range containerDevices.DeviceIds {
+						allocations[containerDevices.ResourceName+"/"+deviceID] = &v1alpha1.Allocation{
+							Namespace: podResources.Namespace,
+							Pod:       podResources.Name,
+							Container: containerResources.Name,
+						}
+					}
+				}
+			}
+		}
+	}
+
+	var devices []v1alpha1.Device
+	for _, pciDevice := range lspci.ListAll() {
+		resource, ok := matchResource(publisher.resources, pciDevice)
+		if !ok {
+			continue
+		}
+
+		device := v1alpha1.Device{
+			Resource:   resource,
+			Slot:       pciDevice.Slot.String(),
+			Vendor:     pciDevice.Vendor.String(),
+			Device:     pciDevice.Device.String(),
+			IOMMUGroup: pciDevice.IOMMUGroup.String(),
+			Driver:     pciDevice.Driver,
+			Allocation: allocations[resource+"/"+pciDevice.Slot.String()],
+		}
+		if pciDevice.SVendor != 0 || pciDevice.SDevice != 0 {
+			device.SubsystemVendor = pciDevice.SVendor.String()
+			device.SubsystemDevice = pciDevice.SDevice.String()
+		}
+		if pciDevice.NUMANode != nil {
+			numaNode := int32(*pciDevice.NUMANode)
+			device.NUMANode = &numaNode
+		}
+		if originalDriver, ok, err := readOriginalDriver(pciDevice.Slot); err != nil {
+			logrus.Debug(err)
+		} else if ok {
+			device.OriginalDriver = originalDriver
+		}
+		if modules := hostModules(pciDevice); len(modules) > 0 {
+			device.Module = modules[0]
+		}
+		if health, ok := deviceHealth.Load(pciDevice.Slot); ok {
+			device.Health = health.(string)
+		}
+		devices = append(devices, device)
+	}
+
+	if deviceInventory.CreationTimestamp.IsZero() {
+		if err := publisher.api.Create(publisher.ctx, deviceInventory); err != nil {
+			return err
+		}
+	} else if reflect.DeepEqual(deviceInventory.Status.Devices, devices) {
+		return nil
+	}
+
+	deviceInventory.Status.Devices = devices
+	deviceInventory.Status.UpdateTime = metav1.Now()
+
+	return publisher.api.Status().Update(publisher.ctx, deviceInventory)
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"os"
+	"strings"
+
+	"github.com/inaccel/device-selector/pkg/lspci"
+	devicepluginv1beta1 "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// iommuEnabled reports whether an IOMMU is registered with the kernel and,
+// if not, a hint about why.
+func iommuEnabled() (bool, string) {
+	if dirEntries, err := os.ReadDir("/sys/class/iommu"); err == nil && len(dirEntries) > 0 {
+		return true, ""
+	}
+
+	cmdline, _ := os.ReadFile("/proc/cmdline")
+	for _, parameter := range strings.Fields(string(cmdline)) {
+		switch parameter {
+		case "intel_iommu=off", "amd_iommu=off", "iommu=off":
+			return false, "IOMMU disabled by " + parameter + " on the kernel command line"
+		}
+	}
+	return false, "no IOMMU registered in /sys/class/iommu, check firmware settings and intel_iommu=on or amd_iommu=on on the kernel command line"
+}
+
+func enableNoIOMMU() error {
+	return os.WriteFile("/sys/module/vfio/parameters/enable_unsafe_noiommu_mode", []byte("1"), 0)
+}
+
+func (resource ResourceConfig) noIOMMU() bool {
+	if !resource.NoIOMMU {
+		return false
+	}
+	enabled, _ := iommuEnabled()
+	return !enabled
+}
+
+func (resource ResourceConfig) checkHealth(pciDevice lspci.PCIDevice) (string, string) {
+	if !responding(pciDevice) {
+		return devicepluginv1beta1.Unhealthy, "not responding on the bus"
+	}
+	if resource.container() || resource.driver() != "vfio-pci" {
+		return devicepluginv1beta1.Healthy, ""
+	}
+	if !pciDevice.IOMMUGroup.Valid && !resource.noIOMMU() {
+		if enabled, reason := iommuEnabled(); !enabled {
+			return devicepluginv1beta1.Unhealthy, reason
+		}
+		return devicepluginv1beta1.Unhealthy, "no IOMMU group"
+	}
+	return devicepluginv1beta1.Healthy, ""
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/inaccel/device-selector/pkg/lspci"
+)
+
+// Driver operations are serialized node-wide per IOMMU group, or per function
+// for devices without one, across all plugin instances. A lock file per key
+// under lockDir extends that to other processes, such as the recover command.
+var deviceLocks sync.Map
+
+const lockDir = "/run/device-selector/locks"
+
+func lockKey(pciDevice lspci.PCIDevice) string {
+	if pciDevice.IOMMUGroup.Valid {
+		return "iommu_group/" + pciDevice.IOMMUGroup.String()
+	}
+	return "device/" + pciDevice.Slot.String()
+}
+
+// lockDevices takes the locks of all the given devices in a fixed order, so
+// that overlapping requests cannot deadlock, and returns the unlock function.
+func lockDevices(pciDevices []lspci.PCIDevice) (func(), error) {
+	var keys []string
+	for _, pciDevice := range pciDevices {
+		keys = append(keys, lockKey(pciDevice))
+	}
+	sort.Strings(keys)
+
+	var unlocks []func()
+	unlock := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for i, key := range keys {
+		if i > 0 && keys[i-1] == key {
+			continue
+		}
+		lock, _ := deviceLocks.LoadOrStore(key, &sync.Mutex{})
+		lock.(*sync.Mutex).Lock()
+		f, err := lockFile(key)
+		if err != nil {
+			lock.(*sync.Mutex).Unlock()
+			unlock()
+			return nil, err
+		}
+		unlocks = append(unlocks, func() {
+			// Closing the file releases the flock.
+			f.Close()
+			lock.(*sync.Mutex).Unlock()
+		})
+	}
+	return unlock, nil
+}
+
+// lockFile takes an exclusive flock on the lock file of key, waiting for any
+// other process that holds it.
+func lockFile(key string) (*os.File, error) {
+	if err := os.MkdirAll(lockDir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(lockDir, strings.ReplaceAll(key, "/", "-")+".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, syscall.EINTR) {
+			f.Close()
+			return nil, fmt.Errorf("lock %s: %w", f.Name(), err)
+		}
+	}
+}
+
+// forEachLockGroup runs fn for the devices of every lock group in parallel,
+// and sequentially within a group.
+func forEachLockGroup(pciDevices []lspci.PCIDevice, fn func(lspci.PCIDevice) error) error {
+	groups := map[string][]lspci.PCIDevice{}
+	for _, pciDevice := range pciDevices {
+		groups[lockKey(pciDevice)] = append(groups[lockKey(pciDevice)], pciDevice)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(pciDevices))
+	i := 0
+	for _, group := range groups {
+		wg.Add(1)
+		go func(group []lspci.PCIDevice, errs []error) {
+			defer wg.Done()
+			for j, pciDevice := range group {
+				if errs[j] = fn(pciDevice); errs[j] != nil {
+					return
+				}
+			}
+		}(group, errs[i:i+len(group)])
+		i += len(group)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/inaccel/device-selector/pkg/lspci"
+	"github.com/inaccel/device-selector/pkg/sysfs/bus/pci"
+)
+
+type hostdevMember struct {
+	pciDevice lspci.PCIDevice
+	function  uint8
+}
+
+// hostdevMembers returns the functions that are passed through for the host
+// device at source, along with the guest function each one is placed at. The
+// functions of the source's allocation unit that share its slot keep their
+// host function, except that a single function unit is placed at function 0;
+// for IOMMU group units, or when a matching policy asks for it, the remaining
+// vfio-pci members of the IOMMU group fill the free functions of the same
+// guest slot. Devices in assigned, which holds those already passed through
+// and those allocated to other pods, are left out, and the members added here
+// are recorded in it.
+func hostdevMembers(source pci.Address, resource, unit string, policies []hostDevicePolicy, pciDevices []lspci.PCIDevice, assigned map[pci.Address]bool) ([]hostdevMember, error) {
+	var members []hostdevMember
+	functions := map[uint8]bool{}
+	included := map[pci.Address]bool{}
+	var iommuGroup lspci.IOMMUGroup
+	expand := unit == iommuGroupUnit
+	for _, pciDevice := range pciDevices {
+		if pciDevice.Slot.SameSlot(source) {
+			if unit == functionUnit && pciDevice.Slot != source {
+				continue
+			}
+			// A single function is the only one in its guest slot, and the
+			// guest only scans a slot that has a function 0.
+			function := pciDevice.Slot.Function
+			if unit == functionUnit {
+				function = 0
+			}
+			members = append(members, hostdevMember{pciDevice, function})
+			functions[function] = true
+			included[pciDevice.Slot] = true
+
+			if pciDevice.Slot == source {
+				iommuGroup = pciDevice.IOMMUGroup
+				for _, policy := range policies {
+					if policy.IOMMUGroup && policy.matches(resource, pciDevice) {
+						expand = true
+					}
+				}
+			}
+		}
+	}
+	if !expand || !iommuGroup.Valid {
+		return members, nil
+	}
+
+	var busy []string
+	for _, pciDevice := range pciDevices {
+		if pciDevice.IOMMUGroup != iommuGroup || included[pciDevice.Slot] || assigned[pciDevice.Slot] {
+			continue
+		}
+		switch {
+		case pciDevice.Class.Base == 0x06:
+		case pciDevice.Driver == "" || pciDevice.Driver == "pci-stub":
+		case pciDevice.Driver == "vfio-pci":
+			function := uint8(8)
+			for i := uint8(0); i < 8; i++ {
+				if !functions[i] {
+					function = i
+					break
+				}
+			}
+			if function == 8 {
+				return nil, fmt.Errorf("iommu group %s cannot be fully passed through: no free guest function for %s", iommuGroup, pciDevice.Slot)
+			}
+			members = append(members, hostdevMember{pciDevice, function})
+			functions[function] = true
+			assigned[pciDevice.Slot] = true
+		default:
+			busy = append(busy, fmt.Sprintf("%s (%s)", pciDevice.Slot, pciDevice.Driver))
+		}
+	}
+	if len(busy) > 0 {
+		return nil, fmt.Errorf("iommu group %s cannot be fully passed through: %s", iommuGroup, strings.Join(busy, ", "))
+	}
+	return members, nil
+}
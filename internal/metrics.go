@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	advertisedDevices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "device_selector",
+		Name:      "advertised_devices",
+		Help:      "Number of devices advertised to the kubelet.",
+	}, []string{"resource"})
+	healthyDevices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "device_selector",
+		Name:      "healthy_devices",
+		Help:      "Number of devices advertised to the kubelet as healthy.",
+	}, []string{"resource"})
+	allocatedDevices = prometheus.NewDesc(
+		"device_selector_allocated_devices",
+		"Number of devices allocated to containers, as reported by the kubelet.",
+		[]string{"resource"}, nil,
+	)
+	allocateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "device_selector",
+		Name:      "allocate_duration_seconds",
+		Help:      "Time taken to serve Allocate requests.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"resource"})
+	allocateFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "device_selector",
+		Name:      "allocate_failures_total",
+		Help:      "Number of failed Allocate requests.",
+	}, []string{"resource"})
+	driverOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "device_selector",
+		Name:      "driver_operations_total",
+		Help:      "Number of driver bind and unbind operations.",
+	}, []string{"driver", "operation"})
+	driverOperationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "device_selector",
+		Name:      "driver_operation_errors_total",
+		Help:      "Number of failed driver bind and unbind operations.",
+	}, []string{"driver", "operation"})
+	hookInvocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "device_selector",
+		Name:      "hook_invocations_total",
+		Help:      "Number of KubeVirt hook invocations.",
+	}, []string{"hook_point"})
+	hookRewrites = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "device_selector",
+		Name:      "hook_rewrites_total",
+		Help:      "Number of host devices rewritten by OnDefineDomain.",
+	})
+	pluginRegistered = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "device_selector",
+		Name:      "plugin_registered",
+		Help:      "Whether the kubelet reported the plugin as registered.",
+	}, []string{"resource"})
+)
+
+var resourceNames sync.Map
+
+func init() {
+	prometheus.MustRegister(
+		advertisedDevices,
+		healthyDevices,
+		allocatedCollector{},
+		allocateDuration,
+		allocateFailures,
+		driverOperations,
+		driverOperationErrors,
+		hookInvocations,
+		hookRewrites,
+		pluginRegistered,
+	)
+}
+
+type allocatedCollector struct{}
+
+func (allocatedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- allocatedDevices
+}
+
+func (allocatedCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	response, err := listPodResources(ctx)
+	if err != nil {
+		logrus.Debug(err)
+		return
+	}
+
+	allocated := map[string]int{}
+	resourceNames.Range(func(resource, _ any) bool {
+		allocated[resource.(string)] = 0
+		return true
+	})
+	for _, podResources := range response.PodResources {
+		for _, containerResources := range podResources.Containers {
+			for _, containerDevices := range containerResources.Devices {
+				if _, ok := allocated[containerDevices.ResourceName]; ok {
+					allocated[containerDevices.ResourceName] += len(containerDevices.DeviceIds)
+				}
+			}
+		}
+	}
+	for resource, count := range allocated {
+		ch <- prometheus.MustNewConstMetric(allocatedDevices, prometheus.GaugeValue, float64(count), resource)
+	}
+}
+
+func observeDriverOperation(driver, operation string, err error) {
+	driverOperations.WithLabelValues(driver, operation).Inc()
+	if err != nil {
+		driverOperationErrors.WithLabelValues(driver, operation).Inc()
+	}
+}
+
+func ServeMetrics(ctx context.Context, address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return serve(ctx, address, mux)
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inaccel/daemon/pkg/plugin"
+	"github.com/inaccel/device-selector/pkg/lspci"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	nodeFeaturePrefix   = "device-selector.inaccel.com/"
+	inventoryAnnotation = nodeFeaturePrefix + "inventory"
+)
+
+type nodeFeaturePublisher struct {
+	ctx  context.Context
+	api  client.Client
+	node string
+
+	resources []ResourceConfig
+	plugin.Plugin
+}
+
+func NewNodeFeaturePublisher(ctx context.Context, api client.Client, node string, resources []ResourceConfig) plugin.New {
+	return func() plugin.Plugin {
+		return newNodeFeaturePublisher(ctx, api, node, resources)
+	}
+}
+
+func newNodeFeaturePublisher(ctx context.Context, api client.Client, node string, resources []ResourceConfig) plugin.Plugin {
+	ctx, cancel := context.WithCancel(ctx)
+
+	nodeFeaturePublisher := &nodeFeaturePublisher{
+		ctx:  ctx,
+		api:  api,
+		node: node,
+	}
+
+	nodeFeaturePublisher.resources = resources
+
+	nodeFeaturePublisher.Plugin = plugin.Base(func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			if err := nodeFeaturePublisher.publish(); err != nil {
+				logrus.Error(err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}, cancel)
+
+	return nodeFeaturePublisher
+}
+
+func (publisher nodeFeaturePublisher) publish() error {
+	var pciDevices []lspci.PCIDevice
+	for _, pciDevice := range lspci.ListAll() {
+		if _, ok := matchResource(publisher.resources, pciDevice); ok {
+			pciDevices = append(pciDevices, pciDevice)
+		}
+	}
+
+	labels := map[string]string{}
+	for _, pciDevice := range pciDevices {
+		names := []string{
+			fmt.Sprintf("pci-%s-%s", pciDevice.Vendor, pciDevice.Device),
+		}
+		if pciDevice.SVendor != 0 && pciDevice.SDevice != 0 {
+			names = append(names, fmt.Sprintf("pci-%s-%s-%s-%s", pciDevice.Vendor, pciDevice.Device, pciDevice.SVendor, pciDevice.SDevice))
+		}
+		for _, name := range names {
+			increment(labels, nodeFeaturePrefix+name+".count")
+			if pciDevice.NUMANode != nil {
+				increment(labels, nodeFeaturePrefix+name+".numa-"+strconv.Itoa(*pciDevice.NUMANode))
+			}
+		}
+	}
+
+	inventory, err := json.Marshal(pciDevices)
+	if err != nil {
+		return err
+	}
+
+	node := &corev1.Node{}
+	if err := publisher.api.Get(publisher.ctx, client.ObjectKey{
+		Name: publisher.node,
+	}, node); err != nil {
+		return err
+	}
+	patch := client.MergeFrom(node.DeepCopy())
+
+	if node.Labels == nil {
+		node.Labels = map[string]string{}
+	}
+	if node.Annotations == nil {
+		node.Annotations = map[string]string{}
+	}
+	unchanged := node.Annotations[inventoryAnnotation] == string(inventory)
+	maps.DeleteFunc(node.Labels, func(key, _ string) bool {
+		if _, ok := labels[key]; strings.HasPrefix(key, nodeFeaturePrefix) && !ok {
+			unchanged = false
+			return true
+		}
+		return false
+	})
+	for key, value := range labels {
+		if node.Labels[key] != value {
+			node.Labels[key] = value
+			unchanged = false
+		}
+	}
+	node.Annotations[inventoryAnnotation] = string(inventory)
+	if unchanged {
+		return nil
+	}
+
+	return publisher.api.Patch(publisher.ctx, node, patch)
+}
+
+func increment(labels map[string]string, key string) {
+	count, _ := strconv.Atoi(labels[key])
+	labels[key] = strconv.Itoa(count + 1)
+}
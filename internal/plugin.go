@@ -2,17 +2,22 @@ package internal
 
 import (
 	"context"
-	"fmt"
+	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/inaccel/daemon/pkg/plugin"
 	"github.com/inaccel/device-selector/pkg/lspci"
 	"github.com/inaccel/device-selector/pkg/sysfs/bus/pci"
 	"github.com/sirupsen/logrus"
-	"github.com/u-root/u-root/pkg/kmodule"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
 	devicepluginv1beta1 "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 	pluginregistrationv1 "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
 	kubevirtv1 "kubevirt.io/api/core/v1"
@@ -23,27 +28,59 @@ type pciHostDevicePlugin struct {
 	ctx  context.Context
 	path string
 
-	pciHostDevice kubevirtv1.PciHostDevice
+	resource ResourceConfig
+	events   *EventRecorder
+	mu       sync.Mutex // guards health
+	health   map[string]string
+	rebound  chan struct{}
+	status   *serverStatus
+	exited
 	plugin.Plugin
+	devicepluginv1beta1.UnimplementedDevicePluginServer
+	pluginregistrationv1.UnimplementedRegistrationServer
 }
 
-func NewPciHostDevicePlugin(ctx context.Context, pciHostDevice kubevirtv1.PciHostDevice) plugin.New {
+func NewPciHostDevicePlugin(ctx context.Context, resource ResourceConfig, events *EventRecorder) plugin.New {
 	return func() plugin.Plugin {
-		return newPciHostDevicePlugin(ctx, pciHostDevice)
+		return newPciHostDevicePlugin(ctx, resource, events)
 	}
 }
 
-func newPciHostDevicePlugin(ctx context.Context, pciHostDevice kubevirtv1.PciHostDevice) plugin.Plugin {
+func newPciHostDevicePlugin(ctx context.Context, resource ResourceConfig, events *EventRecorder) plugin.Plugin {
 	ctx, cancel := context.WithCancel(ctx)
 
 	pciHostDevicePlugin := &pciHostDevicePlugin{
 		ctx:  ctx,
-		path: filepath.Join("/var/lib/kubelet/plugins_registry", pciHostDevice.PCIVendorSelector+".sock"),
+		path: filepath.Join("/var/lib/kubelet/plugins_registry", resource.Selector+".sock"),
 	}
 
-	pciHostDevicePlugin.pciHostDevice = pciHostDevice
+	pciHostDevicePlugin.resource = resource
+	pciHostDevicePlugin.events = events
+	pciHostDevicePlugin.health = map[string]string{}
+	pciHostDevicePlugin.rebound = make(chan struct{}, 1)
+	pciHostDevicePlugin.exited = make(exited)
+
+	pciHostDevicePlugin.status = trackServer(pciHostDevicePlugin.path, resource.ResourceName)
+
+	resourceNames.Store(resource.ResourceName, nil)
 
 	pciHostDevicePlugin.Plugin = plugin.Base(func() {
+		defer close(pciHostDevicePlugin.exited)
+
+		if err := resource.probe(); err != nil {
+			logrus.Error(err)
+		}
+		relist := func() {
+			select {
+			case pciHostDevicePlugin.rebound <- struct{}{}:
+			default:
+			}
+		}
+		go prebindLoop(ctx, []ResourceConfig{resource}, events, relist)
+		if resource.Recover {
+			go recoverLoop(ctx, resource, events, relist)
+		}
+
 		if listener, err := listen(pciHostDevicePlugin.path); err == nil {
 			go func() {
 				<-ctx.Done()
@@ -55,7 +92,13 @@ func newPciHostDevicePlugin(ctx context.Context, pciHostDevice kubevirtv1.PciHos
 			devicepluginv1beta1.RegisterDevicePluginServer(server, pciHostDevicePlugin)
 			pluginregistrationv1.RegisterRegistrationServer(server, pciHostDevicePlugin)
 
-			server.Serve(listener)
+			pciHostDevicePlugin.status.serve(ctx, func() {
+				server.Serve(listener)
+			})
+
+			if resource.CDI && ctx.Err() != nil {
+				os.Remove(cdiSpecPath(resource.ResourceName))
+			}
 		} else {
 			logrus.Error(err)
 		}
@@ -64,76 +107,146 @@ func newPciHostDevicePlugin(ctx context.Context, pciHostDevice kubevirtv1.PciHos
 	return pciHostDevicePlugin
 }
 
-func (plugin pciHostDevicePlugin) Allocate(ctx context.Context, request *devicepluginv1beta1.AllocateRequest) (*devicepluginv1beta1.AllocateResponse, error) {
-	response := &devicepluginv1beta1.AllocateResponse{}
+func (plugin *pciHostDevicePlugin) Allocate(ctx context.Context, request *devicepluginv1beta1.AllocateRequest) (*devicepluginv1beta1.AllocateResponse, error) {
+	start := time.Now()
 
-	for _, modulename := range []string{
-		"vfio_iommu_type1",
-		"vfio_pci",
-	} {
-		if err := kmodule.Probe(modulename, ""); err != nil {
-			return nil, err
+	response, err := plugin.allocate(ctx, request)
+	allocateDuration.WithLabelValues(plugin.resource.ResourceName).Observe(time.Since(start).Seconds())
+	if err != nil {
+		allocateFailures.WithLabelValues(plugin.resource.ResourceName).Inc()
+
+		var devicesIDs []string
+		for _, containerRequest := range request.ContainerRequests {
+			devicesIDs = append(devicesIDs, containerRequest.DevicesIds...)
 		}
+		plugin.events.nodeEvent(corev1.EventTypeWarning, "AllocationFailed", "Failed to allocate %s %v: %v", plugin.resource.ResourceName, devicesIDs, err)
+
+		return nil, err
 	}
-	envKey := util.ResourceNameToEnvVar(kubevirtv1.PCIResourcePrefix, plugin.pciHostDevice.ResourceName)
+
+	return response, nil
+}
+
+func (plugin *pciHostDevicePlugin) allocate(ctx context.Context, request *devicepluginv1beta1.AllocateRequest) (*devicepluginv1beta1.AllocateResponse, error) {
+	response := &devicepluginv1beta1.AllocateResponse{}
+
+	driver := plugin.resource.driver()
+	if err := plugin.resource.probe(); err != nil {
+		return nil, err
+	}
+	envKey := util.ResourceNameToEnvVar(kubevirtv1.PCIResourcePrefix, plugin.resource.ResourceName)
 	for _, containerRequest := range request.ContainerRequests {
 		var envValue string
 		var devices []*devicepluginv1beta1.DeviceSpec
-		for _, devicesID := range containerRequest.DevicesIDs {
-			for _, pciDevice := range lspci.ListAll() {
-				if pciDevice.Slot[:len(pciDevice.Slot)-1] == devicesID[:len(devicesID)-1] {
-					if pciDevice.Driver != "vfio-pci" {
-						if pciDevice.Driver != "" {
-							if err := pci.Driver(pciDevice.Driver).Unbind(pciDevice.Slot); err != nil {
-								return nil, err
-							}
-						}
-						if err := pci.Device(pciDevice.Slot).DriverOverride("vfio-pci"); err != nil {
-							return nil, err
-						}
-						if err := pci.Driver("vfio-pci").Bind(pciDevice.Slot); err != nil {
-							return nil, err
-						}
+		var mounts []*devicepluginv1beta1.Mount
+		var vfioFunctions []lspci.PCIDevice
+		var addresses []pci.Address
+		sort.Strings(containerRequest.DevicesIds)
+		pciDevices := lspci.ListAll()
+		var members [][]lspci.PCIDevice
+		var bound []lspci.PCIDevice
+		for _, devicesID := range containerRequest.DevicesIds {
+			address, err := pci.ParseAddress(devicesID)
+			if err != nil {
+				return nil, err
+			}
+			unit := plugin.resource.members(address, pciDevices)
+			if len(unit) == 0 {
+				return nil, status.Errorf(codes.NotFound, "device %s not found", devicesID)
+			}
+			addresses = append(addresses, address)
+			members = append(members, unit)
+			bound = append(bound, unit...)
+		}
+		rebound, err := plugin.resource.ensureBound(bound)
+		if err != nil {
+			return nil, err
+		}
+		for i, address := range addresses {
+			for _, pciDevice := range members[i] {
+				if plugin.resource.container() {
+					charDevices, err := pci.Device(pciDevice.Slot.String()).CharDevices()
+					if err != nil {
+						return nil, err
 					}
-					if pciDevice.IOMMUGroup != "" {
+					for _, charDevice := range charDevices {
 						devices = append(devices, &devicepluginv1beta1.DeviceSpec{
-							ContainerPath: fmt.Sprintf("/dev/vfio/%s", pciDevice.IOMMUGroup),
-							HostPath:      fmt.Sprintf("/dev/vfio/%s", pciDevice.IOMMUGroup),
-							Permissions:   "mrw",
+							ContainerPath: charDevice,
+							HostPath:      charDevice,
+							Permissions:   "rw",
 						})
 					}
-					if pciDevice.Slot == devicesID {
-						envValue = envValue + pciDevice.Slot
+					path, err := filepath.EvalSymlinks(pci.Device(pciDevice.Slot.String()).Path())
+					if err != nil {
+						return nil, err
 					}
+					mounts = append(mounts, &devicepluginv1beta1.Mount{
+						ContainerPath: path,
+						HostPath:      path,
+					})
+				} else if driver == "vfio-pci" {
+					vfioFunctions = append(vfioFunctions, pciDevice)
+				}
+				if pciDevice.Slot == address {
+					envValue = envValue + pciDevice.Slot.String()
 				}
 			}
 			envValue = envValue + ","
 		}
-		response.ContainerResponses = append(response.ContainerResponses, &devicepluginv1beta1.ContainerAllocateResponse{
+		if plugin.resource.container() {
+			envValue = strings.Join(containerRequest.DevicesIds, ",")
+		} else if driver == "vfio-pci" {
+			for _, path := range plugin.resource.vfioDevices(vfioFunctions) {
+				devices = append(devices, &devicepluginv1beta1.DeviceSpec{
+					ContainerPath: path,
+					HostPath:      path,
+					Permissions:   "mrw",
+				})
+			}
+		}
+		containerResponse := &devicepluginv1beta1.ContainerAllocateResponse{
 			Envs: map[string]string{
 				envKey: envValue,
 			},
-			Devices: append(devices, &devicepluginv1beta1.DeviceSpec{
-				ContainerPath: "/dev/vfio/vfio",
-				HostPath:      "/dev/vfio/vfio",
-				Permissions:   "mrw",
-			}),
-		})
+			Mounts:  mounts,
+			Devices: devices,
+		}
+		if plugin.resource.CDI {
+			for _, address := range addresses {
+				containerResponse.CdiDevices = append(containerResponse.CdiDevices, &devicepluginv1beta1.CDIDevice{
+					Name: cdiDeviceName(plugin.resource.ResourceName, address),
+				})
+			}
+		}
+		response.ContainerResponses = append(response.ContainerResponses, containerResponse)
+
+		for _, pciDevice := range rebound {
+			message := reboundMessage(pciDevice, driver)
+			plugin.events.nodeEvent(corev1.EventTypeNormal, "DriverRebound", "%s", message)
+			plugin.events.podEvent(plugin.resource.ResourceName, containerRequest.DevicesIds, corev1.EventTypeNormal, "DriverRebound", "%s", message)
+		}
+	}
+
+	// Drivers bound above may have created new device nodes.
+	if plugin.resource.CDI {
+		if err := writeCDISpec(plugin.resource); err != nil {
+			return nil, err
+		}
 	}
 
 	return response, nil
 }
 
-func (plugin pciHostDevicePlugin) GetDevicePluginOptions(ctx context.Context, _ *devicepluginv1beta1.Empty) (*devicepluginv1beta1.DevicePluginOptions, error) {
+func (plugin *pciHostDevicePlugin) GetDevicePluginOptions(ctx context.Context, _ *devicepluginv1beta1.Empty) (*devicepluginv1beta1.DevicePluginOptions, error) {
 	options := &devicepluginv1beta1.DevicePluginOptions{}
 
 	return options, nil
 }
 
-func (plugin pciHostDevicePlugin) GetInfo(ctx context.Context, request *pluginregistrationv1.InfoRequest) (*pluginregistrationv1.PluginInfo, error) {
+func (plugin *pciHostDevicePlugin) GetInfo(ctx context.Context, request *pluginregistrationv1.InfoRequest) (*pluginregistrationv1.PluginInfo, error) {
 	response := &pluginregistrationv1.PluginInfo{
 		Type: pluginregistrationv1.DevicePlugin,
-		Name: plugin.pciHostDevice.ResourceName,
+		Name: plugin.resource.ResourceName,
 		SupportedVersions: []string{
 			"v1beta1",
 		},
@@ -142,43 +255,104 @@ func (plugin pciHostDevicePlugin) GetInfo(ctx context.Context, request *pluginre
 	return response, nil
 }
 
-func (plugin pciHostDevicePlugin) GetPreferredAllocation(ctx context.Context, request *devicepluginv1beta1.PreferredAllocationRequest) (*devicepluginv1beta1.PreferredAllocationResponse, error) {
+func (plugin *pciHostDevicePlugin) GetPreferredAllocation(ctx context.Context, request *devicepluginv1beta1.PreferredAllocationRequest) (*devicepluginv1beta1.PreferredAllocationResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
-func (plugin pciHostDevicePlugin) ListAndWatch(_ *devicepluginv1beta1.Empty, server devicepluginv1beta1.DevicePlugin_ListAndWatchServer) error {
-	response := &devicepluginv1beta1.ListAndWatchResponse{}
+func (plugin *pciHostDevicePlugin) ListAndWatch(_ *devicepluginv1beta1.Empty, server devicepluginv1beta1.DevicePlugin_ListAndWatchServer) error {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
 
-	for _, pciDevice := range lspci.ListAll() {
-		if pciDevice.Vendor+":"+pciDevice.Device == plugin.pciHostDevice.PCIVendorSelector {
-			response.Devices = append(response.Devices, &devicepluginv1beta1.Device{
-				ID:     pciDevice.Slot,
-				Health: devicepluginv1beta1.Healthy,
-			})
+	var sent *devicepluginv1beta1.ListAndWatchResponse
+	for {
+		if response := plugin.listDevices(); sent == nil || !sameDevices(sent.Devices, response.Devices) {
+			if plugin.resource.CDI {
+				if err := writeCDISpec(plugin.resource); err != nil {
+					logrus.Error(err)
+				}
+			}
+			if err := server.Send(response); err != nil {
+				return err
+			}
+			sent = response
+		}
+
+		select {
+		case <-plugin.ctx.Done():
+			return nil
+		case <-plugin.rebound:
+		case <-ticker.C:
 		}
 	}
+}
+
+func (plugin *pciHostDevicePlugin) listDevices() *devicepluginv1beta1.ListAndWatchResponse {
+	response := &devicepluginv1beta1.ListAndWatchResponse{}
 
-	if err := server.Send(response); err != nil {
-		return err
+	var healthy int
+	reasons := map[string]string{}
+	pciDevices := lspci.ListAll()
+	for _, pciDevice := range plugin.resource.units(pciDevices) {
+		health, reason := plugin.resource.checkHealth(pciDevice)
+		if health == devicepluginv1beta1.Healthy {
+			health, reason = plugin.resource.checkBound(plugin.resource.members(pciDevice.Slot, pciDevices))
+		}
+		deviceHealth.Store(pciDevice.Slot, health)
+		response.Devices = append(response.Devices, &devicepluginv1beta1.Device{
+			ID:     pciDevice.Slot.String(),
+			Health: health,
+		})
+		if health == devicepluginv1beta1.Healthy {
+			healthy++
+		} else {
+			reasons[pciDevice.Slot.String()] = reason
+		}
 	}
+	// Every ListAndWatch stream lists devices, so only one at a time reports
+	// health changes.
+	plugin.mu.Lock()
+	for _, device := range response.Devices {
+		if health, ok := plugin.health[device.ID]; ok && health != device.Health || !ok && device.Health != devicepluginv1beta1.Healthy {
+			if device.Health == devicepluginv1beta1.Healthy {
+				plugin.events.nodeEvent(corev1.EventTypeNormal, "DeviceHealthy", "Device %s of %s is healthy", device.ID, plugin.resource.ResourceName)
+			} else {
+				logrus.Warnf("%s: unhealthy: %s", device.ID, reasons[device.ID])
 
-	<-plugin.ctx.Done()
+				plugin.events.nodeEvent(corev1.EventTypeWarning, "DeviceUnhealthy", "Device %s of %s is unhealthy: %s", device.ID, plugin.resource.ResourceName, reasons[device.ID])
+			}
+			plugin.health[device.ID] = device.Health
+		}
+	}
+	plugin.mu.Unlock()
+	advertisedDevices.WithLabelValues(plugin.resource.ResourceName).Set(float64(len(response.Devices)))
+	healthyDevices.WithLabelValues(plugin.resource.ResourceName).Set(float64(healthy))
 
-	return nil
+	return response
 }
 
-func (plugin pciHostDevicePlugin) NotifyRegistrationStatus(ctx context.Context, request *pluginregistrationv1.RegistrationStatus) (*pluginregistrationv1.RegistrationStatusResponse, error) {
+func (plugin *pciHostDevicePlugin) NotifyRegistrationStatus(ctx context.Context, request *pluginregistrationv1.RegistrationStatus) (*pluginregistrationv1.RegistrationStatusResponse, error) {
 	response := &pluginregistrationv1.RegistrationStatusResponse{}
 
-	if !request.PluginRegistered {
+	plugin.status.registered.Store(request.PluginRegistered)
+	if request.PluginRegistered {
+		pluginRegistered.WithLabelValues(plugin.resource.ResourceName).Set(1)
+	} else {
+		pluginRegistered.WithLabelValues(plugin.resource.ResourceName).Set(0)
+
 		logrus.Error(request.Error)
 	}
 
 	return response, nil
 }
 
-func (plugin pciHostDevicePlugin) PreStartContainer(ctx context.Context, request *devicepluginv1beta1.PreStartContainerRequest) (*devicepluginv1beta1.PreStartContainerResponse, error) {
+func (plugin *pciHostDevicePlugin) PreStartContainer(ctx context.Context, request *devicepluginv1beta1.PreStartContainerRequest) (*devicepluginv1beta1.PreStartContainerResponse, error) {
 	response := &devicepluginv1beta1.PreStartContainerResponse{}
 
 	return response, nil
 }
+
+func sameDevices(a, b []*devicepluginv1beta1.Device) bool {
+	return slices.EqualFunc(a, b, func(a, b *devicepluginv1beta1.Device) bool {
+		return a.ID == b.ID && a.Health == b.Health
+	})
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/inaccel/device-selector/pkg/sysfs/bus/pci"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	podresourcesv1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+const podResourcesPath = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+const (
+	generatedNameSuffixLength    = 5
+	maxGeneratedNamePrefixLength = 63 - generatedNameSuffixLength
+)
+
+// CheckPodResources fails when the kubelet PodResources socket is not
+// reachable, as is the case inside virt-launcher.
+func CheckPodResources() error {
+	_, err := os.Stat(podResourcesPath)
+	return err
+}
+
+func listPodResources(ctx context.Context) (*podresourcesv1.ListPodResourcesResponse, error) {
+	conn, err := grpc.DialContext(ctx, "unix://"+podResourcesPath, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return podresourcesv1.NewPodResourcesListerClient(conn).List(ctx, &podresourcesv1.ListPodResourcesRequest{})
+}
+
+func podDevices(ctx context.Context, vmi *kubevirtv1.VirtualMachineInstance, container string) (map[string][]string, error) {
+	response, err := listPodResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := map[string][]string{}
+	for _, podResources := range response.PodResources {
+		if podResources.Namespace == vmi.Namespace && launcherPod(vmi, podResources.Name) {
+			for _, containerResources := range podResources.Containers {
+				if containerResources.Name == container {
+					for _, containerDevices := range containerResources.Devices {
+						devices[containerDevices.ResourceName] = append(devices[containerDevices.ResourceName], containerDevices.DeviceIds...)
+					}
+				}
+			}
+		}
+	}
+	return devices, nil
+}
+
+// otherPodDevices returns the PCI devices allocated to pods other than the
+// virt-launcher pod of the VMI.
+func otherPodDevices(ctx context.Context, vmi *kubevirtv1.VirtualMachineInstance) (map[pci.Address]bool, error) {
+	response, err := listPodResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := map[pci.Address]bool{}
+	for _, podResources := range response.PodResources {
+		if podResources.Namespace == vmi.Namespace && launcherPod(vmi, podResources.Name) {
+			continue
+		}
+		for _, containerResources := range podResources.Containers {
+			for _, containerDevices := range containerResources.Devices {
+				for _, devicesID := range containerDevices.DeviceIds {
+					if address, err := pci.ParseAddress(devicesID); err == nil {
+						devices[address] = true
+					}
+				}
+			}
+		}
+	}
+	return devices, nil
+}
+
+// launcherPod reports whether name is the virt-launcher pod of the VMI. The
+// pod is created with generateName, which truncates the prefix and appends
+// a random suffix without dashes, so pods of VMIs whose names merely start
+// with the VMI name do not match.
+func launcherPod(vmi *kubevirtv1.VirtualMachineInstance, name string) bool {
+	prefix := "virt-launcher-" + vmi.Name + "-"
+	if len(prefix) > maxGeneratedNamePrefixLength {
+		prefix = prefix[:maxGeneratedNamePrefixLength]
+	}
+	suffix, ok := strings.CutPrefix(name, prefix)
+	return ok && len(suffix) == generatedNameSuffixLength && !strings.Contains(suffix, "-")
+}
+
+func findPodResources(ctx context.Context, resource string, devicesIDs []string) (*podresourcesv1.PodResources, error) {
+	response, err := listPodResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, podResources := range response.PodResources {
+		for _, containerResources := range podResources.Containers {
+			for _, containerDevices := range containerResources.Devices {
+				if containerDevices.ResourceName == resource {
+					for _, devicesID := range devicesIDs {
+						if slices.Contains(containerDevices.DeviceIds, devicesID) {
+							return podResources, nil
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil, nil
+}
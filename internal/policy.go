@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/beevik/etree"
+	"github.com/inaccel/device-selector/pkg/lspci"
+	kubevirtv1 "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+type hostDevicePolicy struct {
+	Resource string `json:"resource,omitempty"`
+	Vendor   string `json:"vendor,omitempty"`
+	Device   string `json:"device,omitempty"`
+
+	IOMMUGroup bool `json:"iommuGroup,omitempty"`
+
+	ROM     *romPolicy     `json:"rom,omitempty"`
+	Driver  string         `json:"driver,omitempty"`
+	Teaming *teamingPolicy `json:"teaming,omitempty"`
+}
+
+type romPolicy struct {
+	Bar  string `json:"bar,omitempty"`
+	File string `json:"file,omitempty"`
+}
+
+type teamingPolicy struct {
+	Type       string `json:"type"`
+	Persistent string `json:"persistent,omitempty"`
+}
+
+func readHostDevicePolicies(name string) ([]hostDevicePolicy, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var policies []hostDevicePolicy
+	if err := yaml.UnmarshalStrict(data, &policies); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	for index, policy := range policies {
+		if policy.Resource == "" && policy.Vendor == "" {
+			return nil, fmt.Errorf("%s: policy %d: resource or vendor is required", name, index)
+		}
+		if policy.Device != "" && policy.Vendor == "" {
+			return nil, fmt.Errorf("%s: policy %d: device requires vendor", name, index)
+		}
+		if policy.ROM != nil {
+			switch policy.ROM.Bar {
+			case "", "on", "off":
+			default:
+				return nil, fmt.Errorf("%s: policy %d: rom bar must be on or off", name, index)
+			}
+		}
+		if policy.Teaming != nil {
+			switch policy.Teaming.Type {
+			case "transient":
+				if policy.Teaming.Persistent == "" {
+					return nil, fmt.Errorf("%s: policy %d: transient teaming requires persistent", name, index)
+				}
+			default:
+				return nil, fmt.Errorf("%s: policy %d: teaming type must be transient", name, index)
+			}
+		}
+	}
+	return policies, nil
+}
+
+func (policy hostDevicePolicy) matches(resource string, pciDevice lspci.PCIDevice) bool {
+	if policy.Resource != "" && policy.Resource != resource {
+		return false
+	}
+	if policy.Vendor != "" && policy.Vendor != pciDevice.Vendor.String() {
+		return false
+	}
+	if policy.Device != "" && policy.Device != pciDevice.Device.String() {
+		return false
+	}
+	return true
+}
+
+func (policy hostDevicePolicy) apply(hostdev *etree.Element) {
+	if policy.ROM != nil {
+		rom := hostdev.FindElement("rom")
+		if rom == nil {
+			rom = hostdev.CreateElement("rom")
+		}
+		if policy.ROM.Bar != "" {
+			rom.CreateAttr("bar", policy.ROM.Bar)
+		}
+		if policy.ROM.File != "" {
+			rom.CreateAttr("file", policy.ROM.File)
+		}
+	}
+	if policy.Driver != "" {
+		driver := hostdev.FindElement("driver")
+		if driver == nil {
+			driver = hostdev.CreateElement("driver")
+		}
+		driver.CreateAttr("name", policy.Driver)
+	}
+	if policy.Teaming != nil {
+		teaming := hostdev.FindElement("teaming")
+		if teaming == nil {
+			teaming = hostdev.CreateElement("teaming")
+		}
+		teaming.CreateAttr("type", policy.Teaming.Type)
+		teaming.CreateAttr("persistent", policy.Teaming.Persistent)
+	}
+}
+
+func hostDeviceResources(vmi *kubevirtv1.VirtualMachineInstance) map[string]string {
+	resources := map[string]string{}
+	for _, hostDevice := range vmi.Spec.Domain.Devices.HostDevices {
+		resources["ua-hostdevice-"+hostDevice.Name] = hostDevice.DeviceName
+	}
+	for _, gpu := range vmi.Spec.Domain.Devices.GPUs {
+		resources["ua-gpu-"+gpu.Name] = gpu.DeviceName
+	}
+	return resources
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/inaccel/device-selector/pkg/lspci"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	devicepluginv1beta1 "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// checkBound reports prebound devices that are not bound to the driver of
+// the resource yet as unhealthy.
+func (resource ResourceConfig) checkBound(pciDevices []lspci.PCIDevice) (string, string) {
+	if !resource.Prebind {
+		return devicepluginv1beta1.Healthy, ""
+	}
+	for _, pciDevice := range pciDevices {
+		if pciDevice.Driver != resource.driver() {
+			return devicepluginv1beta1.Unhealthy, fmt.Sprintf("%s is not bound to %s yet", pciDevice.Slot, resource.driver())
+		}
+	}
+	return devicepluginv1beta1.Healthy, ""
+}
+
+// ensureBound binds the devices of an allocation, or only validates them
+// when the resource is prebound.
+func (resource ResourceConfig) ensureBound(pciDevices []lspci.PCIDevice) ([]lspci.PCIDevice, error) {
+	if !resource.Prebind {
+		return resource.bindAll(pciDevices)
+	}
+	if health, reason := resource.checkBound(pciDevices); health != devicepluginv1beta1.Healthy {
+		return nil, fmt.Errorf("%s", reason)
+	}
+	return nil, nil
+}
+
+// prebind binds all the devices of the resource that are not bound to its
+// driver, and reports whether any was rebound.
+func (resource ResourceConfig) prebind(events *EventRecorder) bool {
+	pciDevices := lspci.ListAll()
+	var unbound []lspci.PCIDevice
+	for _, unit := range resource.units(pciDevices) {
+		for _, pciDevice := range resource.members(unit.Slot, pciDevices) {
+			if pciDevice.Driver != resource.driver() {
+				unbound = append(unbound, pciDevice)
+			}
+		}
+	}
+	if len(unbound) == 0 {
+		return false
+	}
+
+	if err := resource.probe(); err != nil {
+		logrus.Error(err)
+
+		return false
+	}
+	rebound, err := resource.bindAll(unbound)
+	for _, pciDevice := range rebound {
+		events.nodeEvent(corev1.EventTypeNormal, "DriverRebound", "%s", reboundMessage(pciDevice, resource.driver()))
+	}
+	if err != nil {
+		events.nodeEvent(corev1.EventTypeWarning, "PrebindFailed", "Failed to prebind %s: %v", resource.ResourceName, err)
+	}
+	return len(rebound) > 0
+}
+
+// prebindLoop keeps the prebound resources bound, also across hotplug, and
+// calls rebound whenever a device changed driver.
+func prebindLoop(ctx context.Context, resources []ResourceConfig, events *EventRecorder, rebound func()) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		for _, resource := range resources {
+			if resource.Prebind && resource.prebind(events) {
+				rebound()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func reboundMessage(pciDevice lspci.PCIDevice, driver string) string {
+	if pciDevice.Driver != "" {
+		return fmt.Sprintf("Rebound %s from %s to %s", pciDevice.Slot, pciDevice.Driver, driver)
+	}
+	return fmt.Sprintf("Bound %s to %s", pciDevice.Slot, driver)
+}
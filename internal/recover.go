@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/inaccel/device-selector/pkg/lspci"
+	"github.com/inaccel/device-selector/pkg/sysfs/bus/pci"
+	corev1 "k8s.io/api/core/v1"
+	devicepluginv1beta1 "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// recoverBackoff is the minimum time between automatic recoveries of a
+// device.
+const recoverBackoff = 5 * time.Minute
+
+var recoveries sync.Map
+
+// Recover power-cycles the slot of a device, or removes it and rescans the
+// bus behind its bridge when the slot has no power control. Unless forced,
+// the device must belong to one of the resources and must not be allocated.
+func Recover(ctx context.Context, resources []ResourceConfig, address pci.Address, force bool) error {
+	pciDevices := lspci.ListAll()
+	index := slices.IndexFunc(pciDevices, func(pciDevice lspci.PCIDevice) bool {
+		return pciDevice.Slot == address
+	})
+	if index < 0 {
+		if !force {
+			return fmt.Errorf("%s: not found, use --force to rescan the bus", address)
+		}
+		return pci.Rescan()
+	}
+	pciDevice := pciDevices[index]
+
+	if !force {
+		if err := checkRecoverable(ctx, resources, pciDevice, pciDevices); err != nil {
+			return err
+		}
+	}
+
+	var functions []lspci.PCIDevice
+	for _, other := range pciDevices {
+		if other.Slot.SameSlot(address) {
+			functions = append(functions, other)
+		}
+	}
+	unlock, err := lockDevices(functions)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := resetSlot(ctx, pciDevice, functions); err != nil {
+		return err
+	}
+	// Devices come back bound to their default driver.
+	for _, function := range functions {
+		if err := forgetOriginalDriver(function.Slot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkRecoverable(ctx context.Context, resources []ResourceConfig, pciDevice lspci.PCIDevice, pciDevices []lspci.PCIDevice) error {
+	for _, resource := range resources {
+		for _, unit := range resource.units(pciDevices) {
+			if !resource.sameUnit(unit, pciDevice) {
+				continue
+			}
+			podResources, err := findPodResources(ctx, resource.ResourceName, []string{unit.Slot.String()})
+			if err != nil {
+				return fmt.Errorf("%s: cannot check allocations, use --force to recover anyway: %w", pciDevice.Slot, err)
+			}
+			if podResources != nil {
+				return fmt.Errorf("%s: allocated to pod %s/%s", pciDevice.Slot, podResources.Namespace, podResources.Name)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: not managed by any resource, use --force to recover anyway", pciDevice.Slot)
+}
+
+func resetSlot(ctx context.Context, pciDevice lspci.PCIDevice, functions []lspci.PCIDevice) error {
+	if pciDevice.PhySlot != "" {
+		slot := pci.Slot(pciDevice.PhySlot)
+		if _, err := slot.Power(); err == nil {
+			if err := slot.SetPower(false); err != nil {
+				return err
+			}
+			if err := waitPresent(ctx, pciDevice.Slot, false); err != nil {
+				return err
+			}
+			if err := slot.SetPower(true); err != nil {
+				return err
+			}
+			return waitPresent(ctx, pciDevice.Slot, true)
+		}
+	}
+
+	var bridge pci.Device
+	if path, err := filepath.EvalSymlinks(pci.Device(pciDevice.Slot.String()).Path()); err == nil {
+		if _, err := pci.ParseAddress(filepath.Base(filepath.Dir(path))); err == nil {
+			bridge = pci.Device(filepath.Base(filepath.Dir(path)))
+		}
+	}
+	for i := len(functions) - 1; i >= 0; i-- {
+		if err := pci.Device(functions[i].Slot.String()).Remove(); err != nil {
+			return err
+		}
+	}
+	if err := waitPresent(ctx, pciDevice.Slot, false); err != nil {
+		return err
+	}
+	if bridge != "" {
+		if err := bridge.RescanSecondaryBus(); err != nil {
+			return err
+		}
+	} else if err := pci.Rescan(); err != nil {
+		return err
+	}
+	return waitPresent(ctx, pciDevice.Slot, true)
+}
+
+func waitPresent(ctx context.Context, address pci.Address, present bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	for {
+		if _, err := os.Stat(pci.Device(address.String()).Path()); (err == nil) == present {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if present {
+				return fmt.Errorf("%s: did not come back: %w", address, ctx.Err())
+			}
+			return fmt.Errorf("%s: was not removed: %w", address, ctx.Err())
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// responding reports whether the device still answers configuration reads.
+func responding(pciDevice lspci.PCIDevice) bool {
+	config, err := pci.Device(pciDevice.Slot.String()).Config()
+	if err != nil || len(config) < 2 {
+		return true
+	}
+	return config[0] != 0xff || config[1] != 0xff
+}
+
+// recoverLoop recovers the devices of the resource that stopped responding,
+// and calls recovered after every successful recovery.
+func recoverLoop(ctx context.Context, resource ResourceConfig, events *EventRecorder, recovered func()) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		for _, pciDevice := range resource.units(lspci.ListAll()) {
+			if health, _ := resource.checkHealth(pciDevice); health == devicepluginv1beta1.Healthy || responding(pciDevice) {
+				continue
+			}
+			if resource.autoRecover(ctx, pciDevice.Slot, events) {
+				recovered()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// autoRecover recovers a device that stopped responding, at most once per
+// recoverBackoff across all resources.
+func (resource ResourceConfig) autoRecover(ctx context.Context, address pci.Address, events *EventRecorder) bool {
+	now := time.Now()
+	if last, loaded := recoveries.LoadOrStore(address, now); loaded {
+		if now.Sub(last.(time.Time)) < recoverBackoff || !recoveries.CompareAndSwap(address, last, now) {
+			return false
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	if err := Recover(ctx, []ResourceConfig{resource}, address, false); err != nil {
+		events.nodeEvent(corev1.EventTypeWarning, "RecoveryFailed", "Failed to recover device %s of %s: %v", address, resource.ResourceName, err)
+		return false
+	}
+	events.nodeEvent(corev1.EventTypeNormal, "DeviceRecovered", "Recovered device %s of %s", address, resource.ResourceName)
+	return true
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"github.com/inaccel/device-selector/pkg/lspci"
+	"github.com/inaccel/device-selector/pkg/sysfs/bus/pci"
+)
+
+const (
+	functionUnit   = "function"
+	slotUnit       = "slot"
+	iommuGroupUnit = "iommuGroup"
+)
+
+func (resource ResourceConfig) selects(pciDevice lspci.PCIDevice) bool {
+	return pciDevice.Vendor.String()+":"+pciDevice.Device.String() == resource.Selector
+}
+
+func (resource ResourceConfig) unit() string {
+	if resource.Unit != "" {
+		return resource.Unit
+	}
+	if resource.container() {
+		return functionUnit
+	}
+	return slotUnit
+}
+
+// sameUnit reports whether two devices belong to the same allocation unit.
+func (resource ResourceConfig) sameUnit(a, b lspci.PCIDevice) bool {
+	switch resource.unit() {
+	case functionUnit:
+		return a.Slot == b.Slot
+	case iommuGroupUnit:
+		if a.IOMMUGroup.Valid || b.IOMMUGroup.Valid {
+			return a.IOMMUGroup == b.IOMMUGroup
+		}
+		return a.Slot == b.Slot
+	default:
+		return a.Slot.SameSlot(b.Slot)
+	}
+}
+
+// units returns one device per allocation unit: the lowest addressed
+// selected device, which is also the ID the unit is advertised with.
+func (resource ResourceConfig) units(pciDevices []lspci.PCIDevice) []lspci.PCIDevice {
+	var units []lspci.PCIDevice
+	for _, pciDevice := range pciDevices {
+		if !resource.selects(pciDevice) {
+			continue
+		}
+		var found bool
+		for _, unit := range units {
+			if resource.sameUnit(unit, pciDevice) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			units = append(units, pciDevice)
+		}
+	}
+	return units
+}
+
+// members returns the devices of the allocation unit advertised as
+// devicesID. Bridges sharing an IOMMU group are left to their driver.
+func (resource ResourceConfig) members(devicesID pci.Address, pciDevices []lspci.PCIDevice) []lspci.PCIDevice {
+	var unit *lspci.PCIDevice
+	for index := range pciDevices {
+		if pciDevices[index].Slot == devicesID {
+			unit = &pciDevices[index]
+			break
+		}
+	}
+	if unit == nil {
+		return nil
+	}
+
+	var members []lspci.PCIDevice
+	for _, pciDevice := range pciDevices {
+		if !resource.sameUnit(*unit, pciDevice) {
+			continue
+		}
+		if pciDevice.Slot != devicesID && pciDevice.Class.Base == 0x06 {
+			continue
+		}
+		members = append(members, pciDevice)
+	}
+	return members
+}
+
+type resourceUnits map[string]string
+
+// readResourceUnits reads the allocation unit of every configured resource,
+// so that the hook rewrites hostdevs the way the plugin allocated them.
+func readResourceUnits(name string) (resourceUnits, error) {
+	units := resourceUnits{}
+	if name == "" {
+		return units, nil
+	}
+
+	config, err := ReadConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, resource := range config.Resources {
+		units[resource.ResourceName] = resource.unit()
+	}
+	return units, nil
+}
+
+func (units resourceUnits) of(resource string) string {
+	if unit, ok := units[resource]; ok {
+		return unit
+	}
+	return slotUnit
+}
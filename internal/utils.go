@@ -1,11 +1,27 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 )
 
+// exited is closed once the body of a plugin returns.
+type exited chan struct{}
+
+func (exited exited) wait(timeout time.Duration) bool {
+	select {
+	case <-exited:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 func listen(path string) (net.Listener, error) {
 	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
 		return nil, err
@@ -28,3 +44,22 @@ func listen(path string) (net.Listener, error) {
 
 	return listener, nil
 }
+
+func serve(ctx context.Context, address string, handler http.Handler) error {
+	server := &http.Server{
+		Addr:    address,
+		Handler: handler,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		server.Close()
+	}()
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
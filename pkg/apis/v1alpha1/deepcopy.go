@@ -0,0 +1,79 @@
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func (in *DeviceInventory) DeepCopyInto(out *DeviceInventory) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+func (in *DeviceInventory) DeepCopy() *DeviceInventory {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceInventory)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *DeviceInventory) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+func (in *DeviceInventoryStatus) DeepCopyInto(out *DeviceInventoryStatus) {
+	*out = *in
+	if in.Devices != nil {
+		out.Devices = make([]Device, len(in.Devices))
+		for i := range in.Devices {
+			in.Devices[i].DeepCopyInto(&out.Devices[i])
+		}
+	}
+	in.UpdateTime.DeepCopyInto(&out.UpdateTime)
+}
+
+func (in *Device) DeepCopyInto(out *Device) {
+	*out = *in
+	if in.NUMANode != nil {
+		out.NUMANode = new(int32)
+		*out.NUMANode = *in.NUMANode
+	}
+	if in.Allocation != nil {
+		out.Allocation = new(Allocation)
+		*out.Allocation = *in.Allocation
+	}
+}
+
+func (in *DeviceInventoryList) DeepCopyInto(out *DeviceInventoryList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]DeviceInventory, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+func (in *DeviceInventoryList) DeepCopy() *DeviceInventoryList {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceInventoryList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *DeviceInventoryList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type DeviceInventory struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status DeviceInventoryStatus `json:"status,omitempty"`
+}
+
+type DeviceInventoryStatus struct {
+	Devices    []Device    `json:"devices,omitempty"`
+	UpdateTime metav1.Time `json:"updateTime,omitempty"`
+}
+
+type Device struct {
+	Resource        string      `json:"resource"`
+	Slot            string      `json:"slot"`
+	Vendor          string      `json:"vendor"`
+	Device          string      `json:"device"`
+	SubsystemVendor string      `json:"subsystemVendor,omitempty"`
+	SubsystemDevice string      `json:"subsystemDevice,omitempty"`
+	IOMMUGroup      string      `json:"iommuGroup,omitempty"`
+	NUMANode        *int32      `json:"numaNode,omitempty"`
+	Driver          string      `json:"driver,omitempty"`
+	OriginalDriver  string      `json:"originalDriver,omitempty"`
+	Module          string      `json:"module,omitempty"`
+	Health          string      `json:"health,omitempty"`
+	Allocation      *Allocation `json:"allocation,omitempty"`
+}
+
+type Allocation struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+}
+
+type DeviceInventoryList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []DeviceInventory `json:"items"`
+}
@@ -1,8 +1,10 @@
 package lspci
 
 import (
+	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/inaccel/device-selector/pkg/sysfs/bus/pci"
@@ -10,19 +12,18 @@ import (
 )
 
 type PCIDevice struct {
-	Slot       string
-	Class      string
-	Vendor     string
-	Device     string
-	SVendor    string
-	SDevice    string
+	Slot       pci.Address
+	Class      Class
+	Vendor     ID
+	Device     ID
+	SVendor    ID
+	SDevice    ID
 	PhySlot    string
 	Rev        string
-	ProgIf     string
 	Driver     string
-	NUMANode   string
+	NUMANode   *int
 	DTNode     string
-	IOMMUGroup string
+	IOMMUGroup IOMMUGroup
 }
 
 func ListAll() []PCIDevice {
@@ -32,36 +33,53 @@ func ListAll() []PCIDevice {
 		logrus.Debug(err)
 	}
 	for _, sysfsBusPciDevice := range sysfsBusPciDevices {
+		slot, err := sysfsBusPciDevice.Address()
+		if err != nil {
+			logrus.Debug(err)
+			continue
+		}
 		classRaw, err := sysfsBusPciDevice.Class()
 		if err != nil {
 			logrus.Debug(err)
 			continue
 		}
+		class, err := ParseClass(classRaw)
+		if err != nil {
+			logrus.Warnf("%s: %v", slot, err)
+			continue
+		}
 		deviceRaw, err := sysfsBusPciDevice.Device()
 		if err != nil {
 			logrus.Debug(err)
 			continue
 		}
+		device, err := ParseID(deviceRaw)
+		if err != nil {
+			logrus.Warnf("%s: %v", slot, err)
+			continue
+		}
 		vendorRaw, err := sysfsBusPciDevice.Vendor()
 		if err != nil {
 			logrus.Debug(err)
 			continue
 		}
+		vendor, err := ParseID(vendorRaw)
+		if err != nil {
+			logrus.Warnf("%s: %v", slot, err)
+			continue
+		}
 
-		slot := sysfsBusPciDevice.String()
-		class := strings.TrimPrefix(classRaw, "0x")[:4]
-		vendor := strings.TrimPrefix(vendorRaw, "0x")
-		device := strings.TrimPrefix(deviceRaw, "0x")
-		var sVendor string
-		var sDevice string
+		var sVendor ID
+		var sDevice ID
 		if subsystemVendorRaw, err := sysfsBusPciDevice.SubsystemVendor(); err != nil {
 			logrus.Debug(err)
+		} else if sVendor, err = ParseID(subsystemVendorRaw); err != nil {
+			logrus.Warnf("%s: %v", slot, err)
 		} else {
-			sVendor = strings.TrimPrefix(subsystemVendorRaw, "0x")
 			if subsystemDeviceRaw, err := sysfsBusPciDevice.SubsystemDevice(); err != nil {
 				logrus.Debug(err)
-			} else {
-				sDevice = strings.TrimPrefix(subsystemDeviceRaw, "0x")
+			} else if sDevice, err = ParseID(subsystemDeviceRaw); err != nil {
+				logrus.Warnf("%s: %v", slot, err)
 			}
 		}
 		var phySlot string
@@ -74,7 +92,7 @@ func ListAll() []PCIDevice {
 					logrus.Debug(err)
 					continue
 				}
-				if strings.HasPrefix(sysfsBusPciDevice.String(), address) {
+				if strings.HasPrefix(slot.String(), address+".") {
 					phySlot = sysfsBusPciSlot.String()
 					break
 				}
@@ -86,18 +104,19 @@ func ListAll() []PCIDevice {
 		} else {
 			rev = strings.TrimPrefix(revisionRaw, "0x")
 		}
-		progIf := strings.TrimPrefix(classRaw, "0x")[4:]
 		var driver string
 		if driverRaw, err := sysfsBusPciDevice.Driver(); err != nil {
 			logrus.Debug(err)
 		} else {
 			driver = filepath.Base(driverRaw)
 		}
-		var numaNode string
+		var numaNode *int
 		if numaNodeRaw, err := sysfsBusPciDevice.NumaNode(); err != nil {
 			logrus.Debug(err)
-		} else {
-			numaNode = numaNodeRaw
+		} else if value, err := strconv.Atoi(numaNodeRaw); err != nil {
+			logrus.Warnf("%s: invalid numa node %q: %v", slot, numaNodeRaw, err)
+		} else if value >= 0 {
+			numaNode = &value
 		}
 		var dtNode string
 		if ofNodeRaw, err := sysfsBusPciDevice.OfNode(); err != nil {
@@ -105,11 +124,11 @@ func ListAll() []PCIDevice {
 		} else {
 			dtNode = ofNodeRaw
 		}
-		var iommuGroup string
+		var iommuGroup IOMMUGroup
 		if iommuGroupRaw, err := sysfsBusPciDevice.IommuGroup(); err != nil {
 			logrus.Debug(err)
-		} else {
-			iommuGroup = filepath.Base(iommuGroupRaw)
+		} else if iommuGroup, err = ParseIOMMUGroup(filepath.Base(iommuGroupRaw)); err != nil {
+			logrus.Warnf("%s: %v", slot, err)
 		}
 
 		pciDevices = append(pciDevices, PCIDevice{
@@ -121,7 +140,6 @@ func ListAll() []PCIDevice {
 			sDevice,
 			phySlot,
 			rev,
-			progIf,
 			driver,
 			numaNode,
 			dtNode,
@@ -131,16 +149,60 @@ func ListAll() []PCIDevice {
 	return pciDevices
 }
 
+// UnmarshalJSON also loads snapshots taken before the fields were typed,
+// where NUMANode is a string (-1 when unknown) and the programming interface
+// is a separate ProgIf field next to a four digit Class.
+func (pciDevice *PCIDevice) UnmarshalJSON(data []byte) error {
+	type plain PCIDevice
+	snapshot := struct {
+		*plain
+		NUMANode json.RawMessage
+		ProgIf   string
+	}{
+		plain: (*plain)(pciDevice),
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	pciDevice.NUMANode = nil
+	if len(snapshot.NUMANode) > 0 && string(snapshot.NUMANode) != "null" {
+		var numaNode int
+		if err := json.Unmarshal(snapshot.NUMANode, &numaNode); err != nil {
+			var numaNodeRaw string
+			if json.Unmarshal(snapshot.NUMANode, &numaNodeRaw) != nil {
+				return fmt.Errorf("%s: invalid numa node %s", pciDevice.Slot, snapshot.NUMANode)
+			}
+			if numaNodeRaw == "" {
+				numaNode = -1
+			} else if numaNode, err = strconv.Atoi(numaNodeRaw); err != nil {
+				return fmt.Errorf("%s: invalid numa node %q: %w", pciDevice.Slot, numaNodeRaw, err)
+			}
+		}
+		if numaNode >= 0 {
+			pciDevice.NUMANode = &numaNode
+		}
+	}
+	if snapshot.ProgIf != "" {
+		progIf, err := strconv.ParseUint(snapshot.ProgIf, 16, 8)
+		if err != nil {
+			return fmt.Errorf("%s: invalid programming interface %q: %w", pciDevice.Slot, snapshot.ProgIf, err)
+		}
+		pciDevice.Class.ProgIf = uint8(progIf)
+	}
+	return nil
+}
+
 func (pciDevice *PCIDevice) String() string {
 	var b strings.Builder
 	fmt.Fprintf(&b, "Slot:\t%s\n", pciDevice.Slot)
 	fmt.Fprintf(&b, "Class:\t%s\n", pciDevice.Class)
 	fmt.Fprintf(&b, "Vendor:\t%s\n", pciDevice.Vendor)
 	fmt.Fprintf(&b, "Device:\t%s\n", pciDevice.Device)
-	if pciDevice.SVendor != "" {
+	if pciDevice.SVendor != 0 {
 		fmt.Fprintf(&b, "SVendor:\t%s\n", pciDevice.SVendor)
 	}
-	if pciDevice.SDevice != "" {
+	if pciDevice.SDevice != 0 {
 		fmt.Fprintf(&b, "SDevice:\t%s\n", pciDevice.SDevice)
 	}
 	if pciDevice.PhySlot != "" {
@@ -149,19 +211,17 @@ func (pciDevice *PCIDevice) String() string {
 	if pciDevice.Rev != "" {
 		fmt.Fprintf(&b, "Rev:\t%s\n", pciDevice.Rev)
 	}
-	if pciDevice.ProgIf != "" {
-		fmt.Fprintf(&b, "ProgIf:\t%s\n", pciDevice.ProgIf)
-	}
+	fmt.Fprintf(&b, "ProgIf:\t%02x\n", pciDevice.Class.ProgIf)
 	if pciDevice.Driver != "" {
 		fmt.Fprintf(&b, "Driver:\t%s\n", pciDevice.Driver)
 	}
-	if pciDevice.NUMANode != "" {
-		fmt.Fprintf(&b, "NUMANode:\t%s\n", pciDevice.NUMANode)
+	if pciDevice.NUMANode != nil {
+		fmt.Fprintf(&b, "NUMANode:\t%d\n", *pciDevice.NUMANode)
 	}
 	if pciDevice.DTNode != "" {
 		fmt.Fprintf(&b, "DTNode:\t%s\n", pciDevice.DTNode)
 	}
-	if pciDevice.IOMMUGroup != "" {
+	if pciDevice.IOMMUGroup.Valid {
 		fmt.Fprintf(&b, "IOMMUGroup:\t%s\n", pciDevice.IOMMUGroup)
 	}
 	return b.String()
@@ -0,0 +1,80 @@
+package lspci
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/inaccel/device-selector/pkg/sysfs/bus/pci"
+)
+
+func TestUnmarshalSnapshot(t *testing.T) {
+	numaNode := 1
+	for _, test := range []struct {
+		name      string
+		snapshot  string
+		pciDevice PCIDevice
+	}{
+		{
+			name:     "untyped",
+			snapshot: `{"Slot":"0000:3b:00.0","Class":"0c03","Vendor":"10ee","Device":"5004","SVendor":"","SDevice":"","PhySlot":"","Rev":"00","ProgIf":"30","Driver":"vfio-pci","NUMANode":"1","DTNode":"","IOMMUGroup":"12"}`,
+			pciDevice: PCIDevice{
+				Slot:       pci.Address{Domain: 0x0000, Bus: 0x3b},
+				Class:      Class{Base: 0x0c, Sub: 0x03, ProgIf: 0x30},
+				Vendor:     0x10ee,
+				Device:     0x5004,
+				Rev:        "00",
+				Driver:     "vfio-pci",
+				NUMANode:   &numaNode,
+				IOMMUGroup: IOMMUGroup{Number: 12, Valid: true},
+			},
+		},
+		{
+			name:     "untyped without numa node",
+			snapshot: `{"Slot":"0000:3b:00.1","Class":"1200","Vendor":"10ee","Device":"5005","ProgIf":"00","NUMANode":"-1","IOMMUGroup":""}`,
+			pciDevice: PCIDevice{
+				Slot:   pci.Address{Domain: 0x0000, Bus: 0x3b, Function: 1},
+				Class:  Class{Base: 0x12},
+				Vendor: 0x10ee,
+				Device: 0x5005,
+			},
+		},
+		{
+			name:     "typed",
+			snapshot: `{"Slot":"0000:3b:00.0","Class":"0c0330","Vendor":"10ee","Device":"5004","SVendor":"10ee","SDevice":"0007","NUMANode":1,"IOMMUGroup":"0"}`,
+			pciDevice: PCIDevice{
+				Slot:       pci.Address{Domain: 0x0000, Bus: 0x3b},
+				Class:      Class{Base: 0x0c, Sub: 0x03, ProgIf: 0x30},
+				Vendor:     0x10ee,
+				Device:     0x5004,
+				SVendor:    0x10ee,
+				SDevice:    0x0007,
+				NUMANode:   &numaNode,
+				IOMMUGroup: IOMMUGroup{Number: 0, Valid: true},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var pciDevice PCIDevice
+			if err := json.Unmarshal([]byte(test.snapshot), &pciDevice); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(pciDevice, test.pciDevice) {
+				t.Errorf("got %+v, want %+v", pciDevice, test.pciDevice)
+			}
+
+			// A snapshot taken now loads back the same.
+			data, err := json.Marshal(pciDevice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var reloaded PCIDevice
+			if err := json.Unmarshal(data, &reloaded); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(reloaded, pciDevice) {
+				t.Errorf("%s reloaded as %+v, want %+v", data, reloaded, pciDevice)
+			}
+		})
+	}
+}
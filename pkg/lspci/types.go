@@ -0,0 +1,131 @@
+package lspci
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ID is a vendor or device ID, formatted as four hex digits.
+type ID uint16
+
+func ParseID(s string) (ID, error) {
+	value, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(s), "0x"), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid pci id %q: %w", s, err)
+	}
+	return ID(value), nil
+}
+
+func (id ID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id ID) String() string {
+	return fmt.Sprintf("%04x", uint16(id))
+}
+
+// UnmarshalText accepts an empty ID as zero, which older snapshots recorded
+// for devices without a subsystem.
+func (id *ID) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*id = 0
+		return nil
+	}
+	parsed, err := ParseID(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// Class is a device class code, split into its base class, sub class and
+// programming interface.
+type Class struct {
+	Base   uint8
+	Sub    uint8
+	ProgIf uint8
+}
+
+// ParseClass parses the 24-bit class code sysfs reports (0x060400). The
+// 16-bit form without a programming interface (0604) is accepted as well.
+func ParseClass(s string) (Class, error) {
+	digits := strings.TrimPrefix(strings.TrimSpace(s), "0x")
+	if len(digits) != 4 && len(digits) != 6 {
+		return Class{}, fmt.Errorf("invalid pci class %q", s)
+	}
+	value, err := strconv.ParseUint(digits, 16, 24)
+	if err != nil {
+		return Class{}, fmt.Errorf("invalid pci class %q: %w", s, err)
+	}
+	if len(digits) == 4 {
+		value <<= 8
+	}
+	return Class{
+		Base:   uint8(value >> 16),
+		Sub:    uint8(value >> 8),
+		ProgIf: uint8(value),
+	}, nil
+}
+
+func (class Class) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%02x%02x%02x", class.Base, class.Sub, class.ProgIf)), nil
+}
+
+// String returns the base and sub class, the way lspci -m prints them.
+func (class Class) String() string {
+	return fmt.Sprintf("%02x%02x", class.Base, class.Sub)
+}
+
+func (class *Class) UnmarshalText(text []byte) error {
+	parsed, err := ParseClass(string(text))
+	if err != nil {
+		return err
+	}
+	*class = parsed
+	return nil
+}
+
+// IOMMUGroup is the IOMMU group a device belongs to. The zero value is no
+// group at all, which is not the same as group 0.
+type IOMMUGroup struct {
+	Number int
+	Valid  bool
+}
+
+// ParseIOMMUGroup parses the group number sysfs names the group directory
+// after. An empty string is no group.
+func ParseIOMMUGroup(s string) (IOMMUGroup, error) {
+	if strings.TrimSpace(s) == "" {
+		return IOMMUGroup{}, nil
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(s), 10, 31)
+	if err != nil {
+		return IOMMUGroup{}, fmt.Errorf("invalid iommu group %q: %w", s, err)
+	}
+	return IOMMUGroup{
+		Number: int(value),
+		Valid:  true,
+	}, nil
+}
+
+func (group IOMMUGroup) MarshalText() ([]byte, error) {
+	return []byte(group.String()), nil
+}
+
+func (group IOMMUGroup) String() string {
+	if !group.Valid {
+		return ""
+	}
+	return strconv.Itoa(group.Number)
+}
+
+func (group *IOMMUGroup) UnmarshalText(text []byte) error {
+	parsed, err := ParseIOMMUGroup(string(text))
+	if err != nil {
+		return err
+	}
+	*group = parsed
+	return nil
+}
@@ -0,0 +1,112 @@
+package lspci
+
+import (
+	"testing"
+)
+
+func TestParseID(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		id   ID
+		fail bool
+	}{
+		{s: "0x10ee", id: 0x10ee},
+		{s: "10ee", id: 0x10ee},
+		{s: "0x10ee\n", id: 0x10ee},
+		{s: "0xee", id: 0x00ee},
+		{s: "ee", id: 0x00ee},
+		{s: "0x10ee0", fail: true},
+		{s: "10ee0", fail: true},
+		{s: "0xxyzw", fail: true},
+		{s: "xyzw", fail: true},
+		{s: "", fail: true},
+	} {
+		t.Run(test.s, func(t *testing.T) {
+			id, err := ParseID(test.s)
+			if test.fail {
+				if err == nil {
+					t.Errorf("ParseID(%q) = %s, want error", test.s, id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != test.id {
+				t.Errorf("ParseID(%q) = %s, want %s", test.s, id, test.id)
+			}
+		})
+	}
+}
+
+func TestParseClass(t *testing.T) {
+	for _, test := range []struct {
+		s     string
+		class Class
+		fail  bool
+	}{
+		{s: "0x060400", class: Class{Base: 0x06, Sub: 0x04}},
+		{s: "0x0c0330", class: Class{Base: 0x0c, Sub: 0x03, ProgIf: 0x30}},
+		{s: "0c0330", class: Class{Base: 0x0c, Sub: 0x03, ProgIf: 0x30}},
+		{s: "0x0c0330\n", class: Class{Base: 0x0c, Sub: 0x03, ProgIf: 0x30}},
+		{s: "0x1200", class: Class{Base: 0x12}},
+		{s: "1200", class: Class{Base: 0x12}},
+		{s: "0x12", fail: true},
+		{s: "12", fail: true},
+		{s: "0x06040000", fail: true},
+		{s: "06040000", fail: true},
+		{s: "0x0g0400", fail: true},
+		{s: "zz00", fail: true},
+		{s: "", fail: true},
+	} {
+		t.Run(test.s, func(t *testing.T) {
+			class, err := ParseClass(test.s)
+			if test.fail {
+				if err == nil {
+					t.Errorf("ParseClass(%q) = %+v, want error", test.s, class)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if class != test.class {
+				t.Errorf("ParseClass(%q) = %+v, want %+v", test.s, class, test.class)
+			}
+		})
+	}
+}
+
+func TestParseIOMMUGroup(t *testing.T) {
+	for _, test := range []struct {
+		s     string
+		group IOMMUGroup
+		fail  bool
+	}{
+		{s: "0", group: IOMMUGroup{Number: 0, Valid: true}},
+		{s: "12", group: IOMMUGroup{Number: 12, Valid: true}},
+		{s: "", group: IOMMUGroup{}},
+		{s: "-1", fail: true},
+		{s: "0x0c", fail: true},
+		{s: "group", fail: true},
+	} {
+		t.Run(test.s, func(t *testing.T) {
+			group, err := ParseIOMMUGroup(test.s)
+			if test.fail {
+				if err == nil {
+					t.Errorf("ParseIOMMUGroup(%q) = %+v, want error", test.s, group)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if group != test.group {
+				t.Errorf("ParseIOMMUGroup(%q) = %+v, want %+v", test.s, group, test.group)
+			}
+			if group.String() != test.s {
+				t.Errorf("%+v.String() = %q, want %q", group, group.String(), test.s)
+			}
+		})
+	}
+}
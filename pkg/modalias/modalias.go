@@ -0,0 +1,140 @@
+package modalias
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type alias struct {
+	pattern string
+	module  string
+}
+
+// The running kernel is named by osrelease, and its modules live under
+// modulesRoot. Tests point these and sysModule at fake trees.
+var (
+	osrelease   = "/proc/sys/kernel/osrelease"
+	modulesRoot = "/lib/modules"
+	sysModule   = "/sys/module"
+)
+
+var (
+	resolved sync.Map
+
+	aliases     []alias
+	aliasesErr  error
+	aliasesOnce sync.Once
+
+	builtins     []string
+	builtinsOnce sync.Once
+)
+
+func modulesDir() (string, error) {
+	release, err := os.ReadFile(osrelease)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(modulesRoot, strings.TrimSpace(string(release))), nil
+}
+
+func readAliases() ([]alias, error) {
+	aliasesOnce.Do(func() {
+		dir, err := modulesDir()
+		if err != nil {
+			aliasesErr = err
+			return
+		}
+		f, err := os.Open(filepath.Join(dir, "modules.alias"))
+		if err != nil {
+			aliasesErr = err
+			return
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 3 && fields[0] == "alias" {
+				aliases = append(aliases, alias{
+					pattern: fields[1],
+					module:  Name(fields[2]),
+				})
+			}
+		}
+		aliasesErr = scanner.Err()
+	})
+	return aliases, aliasesErr
+}
+
+// readBuiltins lists the modules in modules.builtin, which also covers the
+// built-in modules that have no parameters and thus no /sys/module entry.
+func readBuiltins() []string {
+	builtinsOnce.Do(func() {
+		dir, err := modulesDir()
+		if err != nil {
+			return
+		}
+		f, err := os.Open(filepath.Join(dir, "modules.builtin"))
+		if err != nil {
+			return
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				builtins = append(builtins, Name(strings.TrimSuffix(path.Base(line), ".ko")))
+			}
+		}
+	})
+	return builtins
+}
+
+// Builtin reports whether the module is compiled into the kernel, either
+// listed in modules.builtin or under /sys/module without an initstate.
+func Builtin(module string) bool {
+	if slices.Contains(readBuiltins(), Name(module)) {
+		return true
+	}
+	if _, err := os.Stat(filepath.Join(sysModule, Name(module))); err != nil {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(sysModule, Name(module), "initstate"))
+	return os.IsNotExist(err)
+}
+
+func Loaded(module string) bool {
+	data, err := os.ReadFile(filepath.Join(sysModule, Name(module), "initstate"))
+	return err == nil && strings.TrimSpace(string(data)) == "live"
+}
+
+// Name normalizes a module name the way the kernel does.
+func Name(module string) string {
+	return strings.ReplaceAll(module, "-", "_")
+}
+
+// Resolve returns the modules whose aliases match the modalias, in the order
+// modprobe would try them.
+func Resolve(modalias string) ([]string, error) {
+	if modules, ok := resolved.Load(modalias); ok {
+		return modules.([]string), nil
+	}
+	aliases, err := readAliases()
+	if err != nil {
+		return nil, err
+	}
+
+	var modules []string
+	for _, alias := range aliases {
+		if ok, _ := path.Match(alias.pattern, modalias); ok && !slices.Contains(modules, alias.module) {
+			modules = append(modules, alias.module)
+		}
+	}
+	resolved.Store(modalias, modules)
+	return modules, nil
+}
@@ -0,0 +1,116 @@
+package modalias
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// newFakeTree points the package at a fake kernel release with a few
+// modules, and forgets what it read from the real one.
+func newFakeTree(t *testing.T) {
+	root := t.TempDir()
+	for name, data := range map[string]string{
+		"proc/sys/kernel/osrelease": "6.1.0-test\n",
+		"lib/modules/6.1.0-test/modules.alias": `# Aliases extracted from modules themselves.
+alias pci:v000010EEd00005004sv*sd*bc*sc*i* xocl
+alias pci:v000010EEd00005005sv*sd*bc*sc*i* xocl
+alias pci:v000010EEd*sv*sd*bc*sc*i* xclmgmt
+alias pci:v*d*sv*sd*bc01sc08i02* nvme
+alias vfio_pci:v*d*sv*sd*bc*sc*i* vfio-pci
+`,
+		"lib/modules/6.1.0-test/modules.builtin": `kernel/drivers/vfio/pci/vfio-pci.ko
+kernel/drivers/nvme/host/nvme-core.ko
+`,
+		"sys/module/xocl/initstate":                              "live\n",
+		"sys/module/xclmgmt/initstate":                           "coming\n",
+		"sys/module/vfio_iommu_type1/parameters/dma_entry_limit": "65535\n",
+	} {
+		name = filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reset := func() {
+		resolved = sync.Map{}
+		aliases, aliasesErr, aliasesOnce = nil, nil, sync.Once{}
+		builtins, builtinsOnce = nil, sync.Once{}
+	}
+	savedOsrelease, savedModulesRoot, savedSysModule := osrelease, modulesRoot, sysModule
+	t.Cleanup(func() {
+		osrelease, modulesRoot, sysModule = savedOsrelease, savedModulesRoot, savedSysModule
+		reset()
+	})
+	osrelease = filepath.Join(root, "proc/sys/kernel/osrelease")
+	modulesRoot = filepath.Join(root, "lib/modules")
+	sysModule = filepath.Join(root, "sys/module")
+	reset()
+}
+
+func TestResolve(t *testing.T) {
+	newFakeTree(t)
+
+	for _, test := range []struct {
+		modalias string
+		modules  []string
+	}{
+		{modalias: "pci:v000010EEd00005004sv000010EEsd0000000Ebc12sc00i00", modules: []string{"xocl", "xclmgmt"}},
+		{modalias: "pci:v000010EEd00005001sv000010EEsd0000000Ebc12sc00i00", modules: []string{"xclmgmt"}},
+		{modalias: "pci:v0000144Dd0000A808sv0000144Dsd0000A801bc01sc08i02", modules: []string{"nvme"}},
+		{modalias: "pci:v000010DEd00001EB8sv000010DEsd000012A2bc03sc02i00"},
+	} {
+		t.Run(test.modalias, func(t *testing.T) {
+			for range 2 {
+				modules, err := Resolve(test.modalias)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(modules, test.modules) {
+					t.Errorf("Resolve(%q) = %q, want %q", test.modalias, modules, test.modules)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveMissingAliases(t *testing.T) {
+	newFakeTree(t)
+	modulesRoot = t.TempDir()
+
+	if modules, err := Resolve("pci:v000010EEd00005004sv000010EEsd0000000Ebc12sc00i00"); err == nil {
+		t.Errorf("Resolve without modules.alias = %q, want error", modules)
+	}
+}
+
+func TestBuiltin(t *testing.T) {
+	newFakeTree(t)
+
+	for _, test := range []struct {
+		module  string
+		builtin bool
+		loaded  bool
+	}{
+		{module: "vfio-pci", builtin: true},
+		{module: "vfio_pci", builtin: true},
+		{module: "nvme_core", builtin: true},
+		{module: "vfio_iommu_type1", builtin: true},
+		{module: "xocl", loaded: true},
+		{module: "xclmgmt"},
+		{module: "nvme"},
+	} {
+		t.Run(test.module, func(t *testing.T) {
+			if builtin := Builtin(test.module); builtin != test.builtin {
+				t.Errorf("Builtin(%q) = %t, want %t", test.module, builtin, test.builtin)
+			}
+			if loaded := Loaded(test.module); loaded != test.loaded {
+				t.Errorf("Loaded(%q) = %t, want %t", test.module, loaded, test.loaded)
+			}
+		})
+	}
+}
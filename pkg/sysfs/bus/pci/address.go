@@ -0,0 +1,119 @@
+package pci
+
+import (
+	"cmp"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Address struct {
+	Domain   uint16
+	Bus      uint8
+	Device   uint8
+	Function uint8
+}
+
+// ParseAddress parses the sysfs form of an address (0000:3b:00.0), or the
+// lspci short form (3b:00.0), which implies domain 0.
+func ParseAddress(s string) (Address, error) {
+	var address Address
+	rest := s
+	if strings.Count(s, ":") == 2 {
+		domain, after, _ := strings.Cut(s, ":")
+		value, err := strconv.ParseUint(domain, 16, 16)
+		if err != nil {
+			return Address{}, fmt.Errorf("invalid pci address %q: domain: %w", s, err)
+		}
+		address.Domain = uint16(value)
+		rest = after
+	}
+	bus, rest, ok := strings.Cut(rest, ":")
+	if !ok {
+		return Address{}, fmt.Errorf("invalid pci address %q", s)
+	}
+	device, function, ok := strings.Cut(rest, ".")
+	if !ok {
+		return Address{}, fmt.Errorf("invalid pci address %q", s)
+	}
+	value, err := strconv.ParseUint(bus, 16, 8)
+	if err != nil {
+		return Address{}, fmt.Errorf("invalid pci address %q: bus: %w", s, err)
+	}
+	address.Bus = uint8(value)
+	if value, err = strconv.ParseUint(device, 16, 5); err != nil {
+		return Address{}, fmt.Errorf("invalid pci address %q: device: %w", s, err)
+	}
+	address.Device = uint8(value)
+	if value, err = strconv.ParseUint(function, 16, 3); err != nil {
+		return Address{}, fmt.Errorf("invalid pci address %q: function: %w", s, err)
+	}
+	address.Function = uint8(value)
+	return address, nil
+}
+
+// ParseLibvirtAddress parses the attributes of a libvirt <address>, which
+// are hex numbers with an optional 0x prefix.
+func ParseLibvirtAddress(domain, bus, slot, function string) (Address, error) {
+	var values [4]uint64
+	for index, field := range []struct {
+		name    string
+		value   string
+		bitSize int
+	}{
+		{"domain", domain, 16},
+		{"bus", bus, 8},
+		{"slot", slot, 5},
+		{"function", function, 3},
+	} {
+		value, err := strconv.ParseUint(strings.TrimPrefix(field.value, "0x"), 16, field.bitSize)
+		if err != nil {
+			return Address{}, fmt.Errorf("invalid libvirt pci address: %s: %w", field.name, err)
+		}
+		values[index] = value
+	}
+	return Address{
+		Domain:   uint16(values[0]),
+		Bus:      uint8(values[1]),
+		Device:   uint8(values[2]),
+		Function: uint8(values[3]),
+	}, nil
+}
+
+func (address Address) Compare(other Address) int {
+	if c := cmp.Compare(address.Domain, other.Domain); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(address.Bus, other.Bus); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(address.Device, other.Device); c != 0 {
+		return c
+	}
+	return cmp.Compare(address.Function, other.Function)
+}
+
+func (address Address) MarshalText() ([]byte, error) {
+	return []byte(address.String()), nil
+}
+
+func (address Address) SameBus(other Address) bool {
+	return address.Domain == other.Domain && address.Bus == other.Bus
+}
+
+func (address Address) SameSlot(other Address) bool {
+	return address.SameBus(other) && address.Device == other.Device
+}
+
+func (address Address) String() string {
+	return fmt.Sprintf("%04x:%02x:%02x.%x", address.Domain, address.Bus, address.Device, address.Function)
+}
+
+func (address *Address) UnmarshalText(text []byte) error {
+	parsed, err := ParseAddress(string(text))
+	if err != nil {
+		return err
+	}
+	*address = parsed
+	return nil
+}
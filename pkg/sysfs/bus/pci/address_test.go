@@ -0,0 +1,193 @@
+package pci
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	for _, test := range []struct {
+		s       string
+		address Address
+		fail    bool
+	}{
+		// sysfs
+		{s: "0000:3b:00.0", address: Address{Bus: 0x3b}},
+		{s: "0000:00:1f.7", address: Address{Device: 0x1f, Function: 7}},
+		{s: "ffff:ff:1f.7", address: Address{Domain: 0xffff, Bus: 0xff, Device: 0x1f, Function: 7}},
+		{s: "10000:3b:00.0", fail: true},
+		{s: "0000:100:00.0", fail: true},
+		{s: "0000:3b:20.0", fail: true},
+		{s: "0000:3b:00.8", fail: true},
+		{s: "0000:3b:00", fail: true},
+		{s: "000g:3b:00.0", fail: true},
+		// lspci -s short form
+		{s: "3b:00.0", address: Address{Bus: 0x3b}},
+		{s: "3b:01.1", address: Address{Bus: 0x3b, Device: 0x01, Function: 1}},
+		{s: "3b:00", fail: true},
+		{s: "3b.00.0", fail: true},
+		{s: "3b:0x00.0", fail: true},
+		// libvirt, which ParseLibvirtAddress handles instead
+		{s: "0x0000:0x3b:0x00.0x0", fail: true},
+		{s: "pci_0000_3b_00_0", fail: true},
+		{s: "", fail: true},
+	} {
+		t.Run(test.s, func(t *testing.T) {
+			address, err := ParseAddress(test.s)
+			if test.fail {
+				if err == nil {
+					t.Errorf("ParseAddress(%q) = %s, want error", test.s, address)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if address != test.address {
+				t.Errorf("ParseAddress(%q) = %s, want %s", test.s, address, test.address)
+			}
+		})
+	}
+}
+
+func TestParseLibvirtAddress(t *testing.T) {
+	for _, test := range []struct {
+		fields  [4]string
+		address Address
+		fail    bool
+	}{
+		{fields: [4]string{"0x0000", "0x3b", "0x00", "0x0"}, address: Address{Bus: 0x3b}},
+		{fields: [4]string{"0000", "3b", "00", "0"}, address: Address{Bus: 0x3b}},
+		{fields: [4]string{"0x0000", "3b", "0x1f", "7"}, address: Address{Bus: 0x3b, Device: 0x1f, Function: 7}},
+		{fields: [4]string{"0xffff", "0xff", "0x1f", "0x7"}, address: Address{Domain: 0xffff, Bus: 0xff, Device: 0x1f, Function: 7}},
+		{fields: [4]string{"0x10000", "0x3b", "0x00", "0x0"}, fail: true},
+		{fields: [4]string{"0x0000", "0x100", "0x00", "0x0"}, fail: true},
+		{fields: [4]string{"0x0000", "0x3b", "0x20", "0x0"}, fail: true},
+		{fields: [4]string{"0x0000", "0x3b", "0x00", "0x8"}, fail: true},
+		{fields: [4]string{"0x0000", "0x3b", "0x00", ""}, fail: true},
+		{fields: [4]string{"0x0000", "0x3b", "0x00", "0x"}, fail: true},
+		{fields: [4]string{"0x0000", "0X3b", "0x00", "0x0"}, fail: true},
+	} {
+		t.Run(fmt.Sprint(test.fields), func(t *testing.T) {
+			address, err := ParseLibvirtAddress(test.fields[0], test.fields[1], test.fields[2], test.fields[3])
+			if test.fail {
+				if err == nil {
+					t.Errorf("ParseLibvirtAddress(%q) = %s, want error", test.fields, address)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if address != test.address {
+				t.Errorf("ParseLibvirtAddress(%q) = %s, want %s", test.fields, address, test.address)
+			}
+		})
+	}
+}
+
+func TestAddressCompare(t *testing.T) {
+	for _, test := range []struct {
+		address, other    Address
+		compare           int
+		sameBus, sameSlot bool
+	}{
+		{
+			address: Address{Bus: 0x3b},
+			other:   Address{Bus: 0x3b},
+			compare: 0, sameBus: true, sameSlot: true,
+		},
+		{
+			address: Address{Bus: 0x3b, Function: 0},
+			other:   Address{Bus: 0x3b, Function: 1},
+			compare: -1, sameBus: true, sameSlot: true,
+		},
+		{
+			address: Address{Bus: 0x3b, Device: 0x01},
+			other:   Address{Bus: 0x3b, Function: 7},
+			compare: 1, sameBus: true,
+		},
+		{
+			address: Address{Bus: 0x3b},
+			other:   Address{Bus: 0x3c},
+			compare: -1,
+		},
+		{
+			address: Address{Domain: 1},
+			other:   Address{Bus: 0xff, Device: 0x1f, Function: 7},
+			compare: 1,
+		},
+		{
+			address: Address{Domain: 1, Bus: 0x3b},
+			other:   Address{Bus: 0x3b},
+			compare: 1,
+		},
+	} {
+		t.Run(fmt.Sprintf("%s %s", test.address, test.other), func(t *testing.T) {
+			if compare := test.address.Compare(test.other); compare != test.compare {
+				t.Errorf("%s.Compare(%s) = %d, want %d", test.address, test.other, compare, test.compare)
+			}
+			if compare := test.other.Compare(test.address); compare != -test.compare {
+				t.Errorf("%s.Compare(%s) = %d, want %d", test.other, test.address, compare, -test.compare)
+			}
+			if sameBus := test.address.SameBus(test.other); sameBus != test.sameBus {
+				t.Errorf("%s.SameBus(%s) = %t, want %t", test.address, test.other, sameBus, test.sameBus)
+			}
+			if sameSlot := test.address.SameSlot(test.other); sameSlot != test.sameSlot {
+				t.Errorf("%s.SameSlot(%s) = %t, want %t", test.address, test.other, sameSlot, test.sameSlot)
+			}
+		})
+	}
+}
+
+func TestAddressText(t *testing.T) {
+	for _, address := range []Address{
+		{},
+		{Bus: 0x3b},
+		{Domain: 0xffff, Bus: 0xff, Device: 0x1f, Function: 7},
+	} {
+		t.Run(address.String(), func(t *testing.T) {
+			text, err := address.MarshalText()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var parsed Address
+			if err := parsed.UnmarshalText(text); err != nil {
+				t.Fatal(err)
+			}
+			if parsed != address {
+				t.Errorf("%s round-tripped through %q to %s", address, text, parsed)
+			}
+		})
+	}
+
+	t.Run("map key", func(t *testing.T) {
+		addresses := map[Address]string{
+			{Bus: 0x3b}:              "nvme",
+			{Bus: 0x3b, Function: 1}: "vfio-pci",
+		}
+		data, err := json.Marshal(addresses)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := `{"0000:3b:00.0":"nvme","0000:3b:00.1":"vfio-pci"}`; string(data) != expected {
+			t.Errorf("got %s, want %s", data, expected)
+		}
+		var parsed map[Address]string
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parsed, addresses) {
+			t.Errorf("got %v, want %v", parsed, addresses)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		var address Address
+		if err := address.UnmarshalText([]byte("3b:00")); err == nil {
+			t.Errorf("UnmarshalText(%q) = %s, want error", "3b:00", address)
+		}
+	})
+}
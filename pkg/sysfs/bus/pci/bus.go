@@ -0,0 +1,53 @@
+package pci
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DriversAutoprobe reports whether new devices are bound to a driver as
+// soon as they are added.
+func DriversAutoprobe() (bool, error) {
+	name, err := filepath.EvalSymlinks(filepath.Join(sysfs, "bus/pci/drivers_autoprobe"))
+	if err != nil {
+		return false, err
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(data)) != "0", nil
+}
+
+// DriversProbe asks the bus to find a driver for the device, honoring its
+// driver_override.
+func DriversProbe(address Address) error {
+	name, err := filepath.EvalSymlinks(filepath.Join(sysfs, "bus/pci/drivers_probe"))
+	if err != nil {
+		return err
+	}
+	return write(name, address.String())
+}
+
+func SetDriversAutoprobe(autoprobe bool) error {
+	name, err := filepath.EvalSymlinks(filepath.Join(sysfs, "bus/pci/drivers_autoprobe"))
+	if err != nil {
+		return err
+	}
+	s := "0"
+	if autoprobe {
+		s = "1"
+	}
+	return write(name, s)
+}
+
+// Rescan enumerates the whole PCI bus again, adding devices that were removed
+// or hot-plugged.
+func Rescan() error {
+	name, err := filepath.EvalSymlinks(filepath.Join(sysfs, "bus/pci/rescan"))
+	if err != nil {
+		return err
+	}
+	return write(name, "1")
+}
@@ -1,13 +1,16 @@
 package pci
 
 import (
+	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
 func Devices() ([]Device, error) {
-	dirEntries, err := os.ReadDir("/sys/bus/pci/devices")
+	dirEntries, err := os.ReadDir(filepath.Join(sysfs, "bus/pci/devices"))
 	if err != nil {
 		return nil, err
 	}
@@ -20,6 +23,43 @@ func Devices() ([]Device, error) {
 
 type Device string
 
+func (device Device) Address() (Address, error) {
+	return ParseAddress(device.String())
+}
+
+func (device Device) CharDevices() ([]string, error) {
+	path, err := filepath.EvalSymlinks(device.Path())
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	if err := filepath.WalkDir(path, func(name string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if dirEntry.Name() == "uevent" && filepath.Dir(name) != path {
+			if devName := charDevName(filepath.Dir(name)); devName != "" && !slices.Contains(names, devName) {
+				names = append(names, devName)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	classes, err := filepath.Glob(filepath.Join(sysfs, "class/*/*/device"))
+	if err != nil {
+		return nil, err
+	}
+	for _, class := range classes {
+		if target, err := filepath.EvalSymlinks(class); err == nil && target == path {
+			if devName := charDevName(filepath.Dir(class)); devName != "" && !slices.Contains(names, devName) {
+				names = append(names, devName)
+			}
+		}
+	}
+	return names, nil
+}
+
 func (device Device) Class() (string, error) {
 	name, err := filepath.EvalSymlinks(filepath.Join(device.Path(), "class"))
 	if err != nil {
@@ -32,6 +72,20 @@ func (device Device) Class() (string, error) {
 	return strings.TrimSpace(string(data)), nil
 }
 
+func (device Device) ClearDriverOverride() error {
+	return device.DriverOverride("\n")
+}
+
+// Config reads the live configuration space of the device, which is all ones
+// once the device stopped responding.
+func (device Device) Config() ([]byte, error) {
+	name, err := filepath.EvalSymlinks(filepath.Join(device.Path(), "config"))
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(name)
+}
+
 func (device Device) Device() (string, error) {
 	name, err := filepath.EvalSymlinks(filepath.Join(device.Path(), "device"))
 	if err != nil {
@@ -53,21 +107,25 @@ func (device Device) DriverOverride(s string) error {
 	if err != nil {
 		return err
 	}
-	f, err := os.OpenFile(name, os.O_WRONLY, 0)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	if _, err := f.WriteString(s); err != nil {
-		return err
-	}
-	return nil
+	return write(name, s)
 }
 
 func (device Device) IommuGroup() (string, error) {
 	return filepath.EvalSymlinks(filepath.Join(device.Path(), "iommu_group"))
 }
 
+func (device Device) Modalias() (string, error) {
+	name, err := filepath.EvalSymlinks(filepath.Join(device.Path(), "modalias"))
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
 func (device Device) NumaNode() (string, error) {
 	name, err := filepath.EvalSymlinks(filepath.Join(device.Path(), "numa_node"))
 	if err != nil {
@@ -88,7 +146,71 @@ func (device Device) Path() string {
 	if strings.Contains(string(device), string(filepath.Separator)) {
 		return string(device)
 	}
-	return filepath.Join("/sys/bus/pci/devices", string(device))
+	return filepath.Join(sysfs, "bus/pci/devices", string(device))
+}
+
+// PCIeRoot returns the root complex the device hangs off, e.g. pci0000:00.
+func (device Device) PCIeRoot() (string, error) {
+	path, err := filepath.EvalSymlinks(device.Path())
+	if err != nil {
+		return "", err
+	}
+	for _, name := range strings.Split(path, string(filepath.Separator)) {
+		if strings.HasPrefix(name, "pci") {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("%s: no pci root in %s", device, path)
+}
+
+// ReadDriverOverride returns the driver the device is forced to, or an
+// empty string when there is none.
+func (device Device) ReadDriverOverride() (string, error) {
+	name, err := filepath.EvalSymlinks(filepath.Join(device.Path(), "driver_override"))
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	if s := strings.TrimSpace(string(data)); s != "(null)" {
+		return s, nil
+	}
+	return "", nil
+}
+
+func (device Device) Remove() error {
+	name, err := filepath.EvalSymlinks(filepath.Join(device.Path(), "remove"))
+	if err != nil {
+		return err
+	}
+	return write(name, "1")
+}
+
+func (device Device) Rescan() error {
+	name, err := filepath.EvalSymlinks(filepath.Join(device.Path(), "rescan"))
+	if err != nil {
+		return err
+	}
+	return write(name, "1")
+}
+
+// RescanSecondaryBus enumerates the buses behind a bridge again.
+func (device Device) RescanSecondaryBus() error {
+	names, err := filepath.Glob(filepath.Join(device.Path(), "pci_bus", "*", "rescan"))
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("%s: not a bridge", device)
+	}
+	for _, name := range names {
+		if err := write(name, "1"); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (device Device) Revision() (string, error) {
@@ -145,3 +267,36 @@ func (device Device) Vendor() (string, error) {
 	}
 	return strings.TrimSpace(string(data)), nil
 }
+
+func (device Device) VfioDev() (string, error) {
+	dirEntries, err := os.ReadDir(filepath.Join(device.Path(), "vfio-dev"))
+	if err != nil {
+		return "", err
+	}
+	for _, dirEntry := range dirEntries {
+		if strings.HasPrefix(dirEntry.Name(), "vfio") {
+			return dirEntry.Name(), nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+func charDevName(path string) string {
+	dev, err := os.ReadFile(filepath.Join(path, "dev"))
+	if err != nil {
+		return ""
+	}
+	if _, err := os.Stat(filepath.Join(sysfs, "dev/char", strings.TrimSpace(string(dev)))); err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(path, "uevent"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if devName, ok := strings.CutPrefix(line, "DEVNAME="); ok {
+			return filepath.Join("/dev", devName)
+		}
+	}
+	return ""
+}
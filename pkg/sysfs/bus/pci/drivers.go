@@ -1,13 +1,14 @@
 package pci
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
 func Drivers() ([]Driver, error) {
-	dirEntries, err := os.ReadDir("/sys/bus/pci/drivers")
+	dirEntries, err := os.ReadDir(filepath.Join(sysfs, "bus/pci/drivers"))
 	if err != nil {
 		return nil, err
 	}
@@ -20,27 +21,37 @@ func Drivers() ([]Driver, error) {
 
 type Driver string
 
-func (driver Driver) Bind(s string) error {
+func (driver Driver) Bind(address Address) error {
 	name, err := filepath.EvalSymlinks(filepath.Join(driver.Path(), "bind"))
 	if err != nil {
 		return err
 	}
-	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	return write(name, address.String())
+}
+
+// NewID makes the driver probe devices matching id, in addition to its
+// static ID table.
+func (driver Driver) NewID(id ID) error {
+	name, err := filepath.EvalSymlinks(filepath.Join(driver.Path(), "new_id"))
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	if _, err := f.WriteString(s); err != nil {
-		return err
-	}
-	return nil
+	return write(name, id.String())
 }
 
 func (driver Driver) Path() string {
 	if strings.Contains(string(driver), string(filepath.Separator)) {
 		return string(driver)
 	}
-	return filepath.Join("/sys/bus/pci/drivers", string(driver))
+	return filepath.Join(sysfs, "bus/pci/drivers", string(driver))
+}
+
+func (driver Driver) RemoveID(id ID) error {
+	name, err := filepath.EvalSymlinks(filepath.Join(driver.Path(), "remove_id"))
+	if err != nil {
+		return err
+	}
+	return write(name, id.String())
 }
 
 func (driver Driver) String() string {
@@ -50,18 +61,28 @@ func (driver Driver) String() string {
 	return filepath.Base(string(driver))
 }
 
-func (driver Driver) Unbind(s string) error {
+func (driver Driver) Unbind(address Address) error {
 	name, err := filepath.EvalSymlinks(filepath.Join(driver.Path(), "unbind"))
 	if err != nil {
 		return err
 	}
-	f, err := os.OpenFile(name, os.O_WRONLY, 0)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	if _, err := f.WriteString(s); err != nil {
-		return err
-	}
-	return nil
+	return write(name, address.String())
+}
+
+// AnyID matches any subsystem vendor or device in an ID.
+const AnyID = 0xffffffff
+
+// ID is a dynamic device ID, as written to new_id and remove_id. Devices
+// match when (class ^ Class) & ClassMask is zero.
+type ID struct {
+	Vendor          uint16
+	Device          uint16
+	SubsystemVendor uint32
+	SubsystemDevice uint32
+	Class           uint32
+	ClassMask       uint32
+}
+
+func (id ID) String() string {
+	return fmt.Sprintf("%04x %04x %x %x %06x %06x", id.Vendor, id.Device, id.SubsystemVendor, id.SubsystemDevice, id.Class, id.ClassMask)
 }
@@ -0,0 +1,143 @@
+package pci
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const rebindAttempts = 5
+
+var (
+	rebindBackoff = 100 * time.Millisecond
+	rebindTimeout = 5 * time.Second
+)
+
+var rebindLocks sync.Map
+
+// Rebind moves the device from whatever driver it is bound to over to
+// driver, or releases it when driver is empty. Unbind and bind are retried
+// on transient errors, and the result is verified through the driver link.
+// On failure the device is bound back to its original driver. Every unbind
+// and bind step, including those of the rollback, is reported to observe
+// when it is not nil.
+func (device Device) Rebind(driver Driver, observe func(driver, operation string, err error)) error {
+	address, err := device.Address()
+	if err != nil {
+		return err
+	}
+	lock, _ := rebindLocks.LoadOrStore(address, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	original := device.currentDriver()
+	if original == driver {
+		return nil
+	}
+	override, err := device.ReadDriverOverride()
+	if err != nil {
+		return err
+	}
+
+	if err := device.rebind(address, original, driver, observe); err != nil {
+		// A failed unbind leaves the device on its original driver, and only
+		// driver_override needs restoring.
+		var rollbackErr error
+		if current := device.currentDriver(); current != original {
+			rollbackErr = device.rebind(address, current, original, observe)
+		}
+		if rollbackErr == nil {
+			rollbackErr = device.setDriverOverride(override)
+		}
+		if rollbackErr != nil {
+			return errors.Join(err, fmt.Errorf("%s: rollback to %q: %w", address, original, rollbackErr))
+		}
+		return err
+	}
+	return nil
+}
+
+func (device Device) rebind(address Address, from, to Driver, observe func(driver, operation string, err error)) error {
+	if observe == nil {
+		observe = func(driver, operation string, err error) {}
+	}
+
+	if from != "" {
+		err := retry(func() error {
+			return from.Unbind(address)
+		})
+		if err != nil {
+			err = fmt.Errorf("%s: unbind from %s: %w", address, from, err)
+		} else {
+			err = device.waitDriver("")
+		}
+		observe(string(from), "unbind", err)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := device.setDriverOverride(string(to)); err != nil {
+		return fmt.Errorf("%s: driver_override: %w", address, err)
+	}
+	if to == "" {
+		return nil
+	}
+
+	err := retry(func() error {
+		return to.Bind(address)
+	})
+	if err != nil {
+		err = fmt.Errorf("%s: bind to %s: %w", address, to, err)
+	} else {
+		err = device.waitDriver(to)
+	}
+	observe(string(to), "bind", err)
+	return err
+}
+
+func (device Device) currentDriver() Driver {
+	name, err := device.Driver()
+	if err != nil {
+		return ""
+	}
+	return Driver(filepath.Base(name))
+}
+
+func (device Device) setDriverOverride(driver string) error {
+	if driver == "" {
+		return device.ClearDriverOverride()
+	}
+	return device.DriverOverride(driver)
+}
+
+func (device Device) waitDriver(driver Driver) error {
+	deadline := time.Now().Add(rebindTimeout)
+	for {
+		current := device.currentDriver()
+		if current == driver {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if driver == "" {
+				return fmt.Errorf("%s: still bound to %s", device, current)
+			}
+			return fmt.Errorf("%s: bound to %q instead of %s", device, current, driver)
+		}
+		time.Sleep(rebindBackoff)
+	}
+}
+
+func retry(fn func() error) error {
+	var err error
+	for attempt := 1; attempt <= rebindAttempts; attempt++ {
+		if err = fn(); err == nil || !errors.Is(err, syscall.EBUSY) && !errors.Is(err, syscall.ENODEV) {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * rebindBackoff)
+	}
+	return err
+}
@@ -0,0 +1,322 @@
+package pci
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeKernel stands in for the kernel behind a fake sysfs tree with one
+// device and a couple of drivers.
+type fakeKernel struct {
+	root string
+
+	// unbindErrors and bindErrors are returned, one per write, before the
+	// writes to a driver's unbind and bind take effect.
+	unbindErrors map[Driver][]error
+	bindErrors   map[Driver][]error
+	// ignoreBind lists drivers that accept a bind without binding.
+	ignoreBind map[Driver]bool
+
+	writes map[string]int
+}
+
+const fakeDevice = Device("0000:03:00.0")
+
+func newFakeKernel(t *testing.T, driver Driver, override string) *fakeKernel {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kernel := &fakeKernel{
+		root:         root,
+		unbindErrors: map[Driver][]error{},
+		bindErrors:   map[Driver][]error{},
+		ignoreBind:   map[Driver]bool{},
+		writes:       map[string]int{},
+	}
+
+	for _, name := range []string{"nvme", "vfio-pci"} {
+		for _, attribute := range []string{"bind", "unbind"} {
+			kernel.create(t, filepath.Join("bus/pci/drivers", name, attribute), "")
+		}
+	}
+	if override == "" {
+		override = "(null)"
+	}
+	kernel.create(t, filepath.Join("bus/pci/devices", fakeDevice.String(), "driver_override"), override+"\n")
+	if driver != "" {
+		if err := kernel.bind(driver); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	savedSysfs, savedWrite, savedBackoff, savedTimeout := sysfs, write, rebindBackoff, rebindTimeout
+	t.Cleanup(func() {
+		sysfs, write, rebindBackoff, rebindTimeout = savedSysfs, savedWrite, savedBackoff, savedTimeout
+	})
+	sysfs, write = root, kernel.write
+	rebindBackoff, rebindTimeout = time.Millisecond, 50*time.Millisecond
+
+	return kernel
+}
+
+func (kernel *fakeKernel) create(t *testing.T, name, data string) {
+	name = filepath.Join(kernel.root, name)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (kernel *fakeKernel) link() string {
+	return filepath.Join(kernel.root, "bus/pci/devices", fakeDevice.String(), "driver")
+}
+
+func (kernel *fakeKernel) bind(driver Driver) error {
+	return os.Symlink(filepath.Join(kernel.root, "bus/pci/drivers", string(driver)), kernel.link())
+}
+
+func (kernel *fakeKernel) write(name, s string) error {
+	attribute := filepath.Base(name)
+	driver := Driver(filepath.Base(filepath.Dir(name)))
+	kernel.writes[string(driver)+"/"+attribute]++
+
+	switch attribute {
+	case "driver_override":
+		if strings.TrimSpace(s) == "" {
+			s = "(null)"
+		}
+		return os.WriteFile(name, []byte(strings.TrimSpace(s)+"\n"), 0644)
+	case "unbind":
+		if errs := kernel.unbindErrors[driver]; len(errs) > 0 {
+			kernel.unbindErrors[driver] = errs[1:]
+			return errs[0]
+		}
+		if current, _ := fakeDevice.Driver(); filepath.Base(current) != string(driver) {
+			return syscall.ENODEV
+		}
+		return os.Remove(kernel.link())
+	case "bind":
+		if errs := kernel.bindErrors[driver]; len(errs) > 0 {
+			kernel.bindErrors[driver] = errs[1:]
+			return errs[0]
+		}
+		if override, _ := fakeDevice.ReadDriverOverride(); override != "" && override != string(driver) {
+			return syscall.ENODEV
+		}
+		if _, err := fakeDevice.Driver(); err == nil {
+			return syscall.EBUSY
+		}
+		if kernel.ignoreBind[driver] {
+			return nil
+		}
+		return kernel.bind(driver)
+	}
+	return fmt.Errorf("unexpected write to %s", name)
+}
+
+type observation struct {
+	driver    string
+	operation string
+	failed    bool
+}
+
+func observer(observations *[]observation) func(driver, operation string, err error) {
+	return func(driver, operation string, err error) {
+		*observations = append(*observations, observation{driver, operation, err != nil})
+	}
+}
+
+func assertDriver(t *testing.T, driver Driver, override string) {
+	t.Helper()
+	if current := fakeDevice.currentDriver(); current != driver {
+		t.Errorf("bound to %q, want %q", current, driver)
+	}
+	current, err := fakeDevice.ReadDriverOverride()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != override {
+		t.Errorf("driver_override is %q, want %q", current, override)
+	}
+}
+
+func TestRebindRetriesBusy(t *testing.T) {
+	kernel := newFakeKernel(t, "nvme", "")
+	kernel.unbindErrors["nvme"] = []error{syscall.EBUSY, syscall.EBUSY}
+	kernel.bindErrors["vfio-pci"] = []error{syscall.EBUSY}
+
+	var observations []observation
+	if err := fakeDevice.Rebind("vfio-pci", observer(&observations)); err != nil {
+		t.Fatal(err)
+	}
+
+	assertDriver(t, "vfio-pci", "vfio-pci")
+	if writes := kernel.writes["nvme/unbind"]; writes != 3 {
+		t.Errorf("unbind written %d times, want 3", writes)
+	}
+	if writes := kernel.writes["vfio-pci/bind"]; writes != 2 {
+		t.Errorf("bind written %d times, want 2", writes)
+	}
+	if expected := []observation{
+		{"nvme", "unbind", false},
+		{"vfio-pci", "bind", false},
+	}; !reflect.DeepEqual(observations, expected) {
+		t.Errorf("observed %v, want %v", observations, expected)
+	}
+}
+
+func TestRebindVerificationTimeout(t *testing.T) {
+	kernel := newFakeKernel(t, "nvme", "")
+	kernel.ignoreBind["vfio-pci"] = true
+
+	var observations []observation
+	err := fakeDevice.Rebind("vfio-pci", observer(&observations))
+	if err == nil || !strings.Contains(err.Error(), `bound to "" instead of vfio-pci`) {
+		t.Fatalf("got %v, want a verification error", err)
+	}
+
+	assertDriver(t, "nvme", "")
+	if expected := []observation{
+		{"nvme", "unbind", false},
+		{"vfio-pci", "bind", true},
+		{"nvme", "bind", false},
+	}; !reflect.DeepEqual(observations, expected) {
+		t.Errorf("observed %v, want %v", observations, expected)
+	}
+}
+
+func TestRebindRollsBack(t *testing.T) {
+	kernel := newFakeKernel(t, "nvme", "")
+	kernel.bindErrors["vfio-pci"] = []error{syscall.EINVAL}
+
+	var observations []observation
+	err := fakeDevice.Rebind("vfio-pci", observer(&observations))
+	if !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("got %v, want %v", err, syscall.EINVAL)
+	}
+
+	assertDriver(t, "nvme", "")
+	if writes := kernel.writes["vfio-pci/bind"]; writes != 1 {
+		t.Errorf("bind written %d times, want 1", writes)
+	}
+	if expected := []observation{
+		{"nvme", "unbind", false},
+		{"vfio-pci", "bind", true},
+		{"nvme", "bind", false},
+	}; !reflect.DeepEqual(observations, expected) {
+		t.Errorf("observed %v, want %v", observations, expected)
+	}
+}
+
+func TestRebindUnbindFails(t *testing.T) {
+	kernel := newFakeKernel(t, "nvme", "")
+	kernel.unbindErrors["nvme"] = []error{syscall.EINVAL}
+
+	var observations []observation
+	err := fakeDevice.Rebind("vfio-pci", observer(&observations))
+	if !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("got %v, want %v", err, syscall.EINVAL)
+	}
+
+	assertDriver(t, "nvme", "")
+	if writes := kernel.writes["nvme/unbind"]; writes != 1 {
+		t.Errorf("unbind written %d times, want 1", writes)
+	}
+	if writes := kernel.writes["nvme/bind"] + kernel.writes["vfio-pci/bind"]; writes != 0 {
+		t.Errorf("bind written %d times, want 0", writes)
+	}
+	if expected := []observation{
+		{"nvme", "unbind", true},
+	}; !reflect.DeepEqual(observations, expected) {
+		t.Errorf("observed %v, want %v", observations, expected)
+	}
+}
+
+func TestRebindPersistentNoDevice(t *testing.T) {
+	enodev := make([]error, rebindAttempts)
+	for index := range enodev {
+		enodev[index] = syscall.ENODEV
+	}
+
+	for _, test := range []struct {
+		name         string
+		unbindErrors []error
+		bindErrors   []error
+		writes       map[string]int
+		observations []observation
+	}{
+		{
+			name:         "unbind",
+			unbindErrors: enodev,
+			writes: map[string]int{
+				"nvme/unbind":   rebindAttempts,
+				"vfio-pci/bind": 0,
+				"nvme/bind":     0,
+			},
+			observations: []observation{
+				{"nvme", "unbind", true},
+			},
+		},
+		{
+			name:       "bind",
+			bindErrors: enodev,
+			writes: map[string]int{
+				"nvme/unbind":   1,
+				"vfio-pci/bind": rebindAttempts,
+				"nvme/bind":     1,
+			},
+			observations: []observation{
+				{"nvme", "unbind", false},
+				{"vfio-pci", "bind", true},
+				{"nvme", "bind", false},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			kernel := newFakeKernel(t, "nvme", "")
+			kernel.unbindErrors["nvme"] = test.unbindErrors
+			kernel.bindErrors["vfio-pci"] = test.bindErrors
+
+			var observations []observation
+			err := fakeDevice.Rebind("vfio-pci", observer(&observations))
+			if !errors.Is(err, syscall.ENODEV) {
+				t.Fatalf("got %v, want %v", err, syscall.ENODEV)
+			}
+
+			assertDriver(t, "nvme", "")
+			for name, writes := range test.writes {
+				if kernel.writes[name] != writes {
+					t.Errorf("%s written %d times, want %d", name, kernel.writes[name], writes)
+				}
+			}
+			if !reflect.DeepEqual(observations, test.observations) {
+				t.Errorf("observed %v, want %v", observations, test.observations)
+			}
+		})
+	}
+}
+
+func TestRebindRestoresDriverOverride(t *testing.T) {
+	for _, override := range []string{"", "nvme"} {
+		t.Run(fmt.Sprintf("%q", override), func(t *testing.T) {
+			kernel := newFakeKernel(t, "nvme", override)
+			kernel.bindErrors["vfio-pci"] = []error{syscall.EINVAL}
+
+			if err := fakeDevice.Rebind("vfio-pci", nil); err == nil {
+				t.Fatal("rebind succeeded")
+			}
+
+			assertDriver(t, "nvme", override)
+		})
+	}
+}
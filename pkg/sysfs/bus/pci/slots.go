@@ -3,11 +3,12 @@ package pci
 import (
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 func Slots() ([]Slot, error) {
-	dirEntries, err := os.ReadDir("/sys/bus/pci/slots")
+	dirEntries, err := os.ReadDir(filepath.Join(sysfs, "bus/pci/slots"))
 	if err != nil {
 		return nil, err
 	}
@@ -32,11 +33,70 @@ func (slot Slot) Address() (string, error) {
 	return strings.TrimSpace(string(data)), nil
 }
 
+// Attention returns the state of the attention indicator: 0 off, 1 on and
+// 2 blinking.
+func (slot Slot) Attention() (int, error) {
+	name, err := filepath.EvalSymlinks(filepath.Join(slot.Path(), "attention"))
+	if err != nil {
+		return 0, err
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// Latch reports whether the retention latch of the slot is closed.
+func (slot Slot) Latch() (bool, error) {
+	name, err := filepath.EvalSymlinks(filepath.Join(slot.Path(), "latch"))
+	if err != nil {
+		return false, err
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(data)) != "0", nil
+}
+
 func (slot Slot) Path() string {
 	if strings.Contains(string(slot), string(filepath.Separator)) {
 		return string(slot)
 	}
-	return filepath.Join("/sys/bus/pci/slots", string(slot))
+	return filepath.Join(sysfs, "bus/pci/slots", string(slot))
+}
+
+func (slot Slot) Power() (bool, error) {
+	name, err := filepath.EvalSymlinks(filepath.Join(slot.Path(), "power"))
+	if err != nil {
+		return false, err
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(data)) != "0", nil
+}
+
+func (slot Slot) SetAttention(attention int) error {
+	name, err := filepath.EvalSymlinks(filepath.Join(slot.Path(), "attention"))
+	if err != nil {
+		return err
+	}
+	return write(name, strconv.Itoa(attention))
+}
+
+func (slot Slot) SetPower(power bool) error {
+	name, err := filepath.EvalSymlinks(filepath.Join(slot.Path(), "power"))
+	if err != nil {
+		return err
+	}
+	s := "0"
+	if power {
+		s = "1"
+	}
+	return write(name, s)
 }
 
 func (slot Slot) String() string {
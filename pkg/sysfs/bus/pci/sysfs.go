@@ -0,0 +1,22 @@
+package pci
+
+import (
+	"os"
+)
+
+// sysfs is where sysfs is mounted. Tests point it at a fake tree.
+var sysfs = "/sys"
+
+// write writes s to the sysfs attribute at name. Tests replace it to play the
+// kernel's part.
+var write = func(name, s string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(s); err != nil {
+		return err
+	}
+	return nil
+}